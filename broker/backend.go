@@ -2,7 +2,11 @@ package broker
 
 import (
 	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/256dpi/gomqtt/packet"
@@ -30,14 +34,17 @@ func newMemorySession(backlog int) *memorySession {
 }
 
 func (s *memorySession) lookupSubscription(topic string) *packet.Subscription {
-	values := s.subscriptions.Match(topic)
-
-	if len(values) > 0 {
-		sub := values[0].(packet.Subscription)
-		return &sub
+	// get the subscription with the highest qos as the message is delivered
+	// only once for overlapping subscriptions
+	var sub *packet.Subscription
+	for _, value := range s.subscriptions.Match(topic) {
+		match := value.(packet.Subscription)
+		if sub == nil || match.QOS > sub.QOS {
+			sub = &match
+		}
 	}
 
-	return nil
+	return sub
 }
 
 func (s *memorySession) applyQOS(msg *packet.Message) *packet.Message {
@@ -54,10 +61,253 @@ func (s *memorySession) applyQOS(msg *packet.Message) *packet.Message {
 	return msg
 }
 
+type sharedGroup struct {
+	filter  string
+	members map[*memorySession]packet.Subscription
+}
+
+// parseShared will split a shared subscription topic in its group and filter.
+func parseShared(t string) (string, string, bool) {
+	// check prefix
+	if !strings.HasPrefix(t, "$share/") {
+		return "", "", false
+	}
+
+	// split group and filter
+	segments := strings.SplitN(strings.TrimPrefix(t, "$share/"), "/", 2)
+	if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+		return "", "", false
+	}
+
+	// check group
+	if topic.ContainsWildcards(segments[0]) {
+		return "", "", false
+	}
+
+	return segments[0], segments[1], true
+}
+
+// pick will randomly select a member of the group. Online members are
+// preferred over offline members.
+func (g *sharedGroup) pick() (*memorySession, packet.Subscription) {
+	// collect online members
+	var list []*memorySession
+	for sess := range g.members {
+		if sess.owner != nil {
+			list = append(list, sess)
+		}
+	}
+
+	// fallback to all members
+	if len(list) == 0 {
+		for sess := range g.members {
+			list = append(list, sess)
+		}
+	}
+
+	// select member
+	sess := list[rand.Intn(len(list))]
+
+	return sess, g.members[sess]
+}
+
 func (s *memorySession) reuse() {
 	s.temporary = make(chan *packet.Message, cap(s.temporary))
 }
 
+// queued returns the messages in the stored queue without removing them. It
+// must not be called while messages are dequeued.
+func (s *memorySession) queued() []*packet.Message {
+	// get length
+	n := len(s.stored)
+
+	// rotate queue
+	list := make([]*packet.Message, 0, n)
+	for i := 0; i < n; i++ {
+		msg := <-s.stored
+		list = append(list, msg)
+		s.stored <- msg
+	}
+
+	return list
+}
+
+// An Authorizer decides whether clients may publish or subscribe to topics.
+type Authorizer interface {
+	// CanPublish should return whether the client may publish to the topic.
+	CanPublish(clientID, topic string) bool
+
+	// CanSubscribe should return whether the client may subscribe to the
+	// filter.
+	CanSubscribe(clientID, filter string) bool
+}
+
+// A RetainedStore stores the last retained message per topic.
+type RetainedStore interface {
+	// Store should store the message as the retained message of its topic. An
+	// eventual existing message gets overwritten.
+	Store(msg *packet.Message) error
+
+	// Clear should remove the retained message of the specified topic.
+	Clear(topic string) error
+
+	// Search should return all retained messages matching the filter.
+	Search(filter string) ([]*packet.Message, error)
+}
+
+// A MemoryRetainedStore stores retained messages in memory.
+type MemoryRetainedStore struct {
+	tree *topic.Tree
+}
+
+// NewMemoryRetainedStore returns a new MemoryRetainedStore.
+func NewMemoryRetainedStore() *MemoryRetainedStore {
+	return &MemoryRetainedStore{
+		tree: topic.NewTree(),
+	}
+}
+
+// Store will store the message as the retained message of its topic.
+func (s *MemoryRetainedStore) Store(msg *packet.Message) error {
+	s.tree.Set(msg.Topic, msg)
+	return nil
+}
+
+// Clear will remove the retained message of the specified topic.
+func (s *MemoryRetainedStore) Clear(topic string) error {
+	s.tree.Empty(topic)
+	return nil
+}
+
+// Search will return all retained messages matching the filter.
+func (s *MemoryRetainedStore) Search(filter string) ([]*packet.Message, error) {
+	// search tree
+	values := s.tree.Search(filter)
+
+	// convert values
+	msgs := make([]*packet.Message, 0, len(values))
+	for _, value := range values {
+		msgs = append(msgs, value.(*packet.Message))
+	}
+
+	return msgs, nil
+}
+
+// Count will return the number of retained messages.
+func (s *MemoryRetainedStore) Count() int {
+	return s.tree.Count()
+}
+
+// Metrics is a snapshot of the counters maintained by a MemoryBackend.
+type Metrics struct {
+	// The total number of accepted connections and the number of currently
+	// open connections.
+	Connections       uint64
+	ActiveConnections int64
+
+	// The number of messages that have been received from clients, queued for
+	// clients and dropped because they have been denied or could not be
+	// queued.
+	MessagesReceived uint64
+	MessagesSent     uint64
+	MessagesDropped  uint64
+
+	// The number of retained messages. It is only available if the retained
+	// store implements a Count() int method like the MemoryRetainedStore.
+	Retained int
+
+	// The number of subscriptions including shared subscriptions.
+	Subscriptions int
+
+	// The number of bytes that have been sent to and received from clients.
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// A SessionState holds the persisted state of a stored session.
+type SessionState struct {
+	// The subscriptions of the session including shared subscriptions.
+	Subscriptions []packet.Subscription
+
+	// The incoming and outgoing packets that are awaiting acknowledgement.
+	Incoming []packet.Generic
+	Outgoing []packet.Generic
+
+	// The queued QOS 1 and 2 messages that have not yet been delivered.
+	Messages []*packet.Message
+}
+
+// A SessionStore persists the state of stored sessions by client id.
+type SessionStore interface {
+	// Save should store the state of the session with the specified id. An
+	// eventual existing state gets overwritten.
+	Save(id string, state *SessionState) error
+
+	// Load should return the state of the session with the specified id or nil
+	// if no state has been stored.
+	Load(id string) (*SessionState, error)
+
+	// Remove should delete the state of the session with the specified id.
+	Remove(id string) error
+
+	// List should return the ids of all stored sessions.
+	List() ([]string, error)
+}
+
+// A MemorySessionStore stores session states in memory.
+type MemorySessionStore struct {
+	states map[string]*SessionState
+	mutex  sync.Mutex
+}
+
+// NewMemorySessionStore returns a new MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		states: make(map[string]*SessionState),
+	}
+}
+
+// Save will store the state of the session with the specified id.
+func (s *MemorySessionStore) Save(id string, state *SessionState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.states[id] = state
+
+	return nil
+}
+
+// Load will return the state of the session with the specified id.
+func (s *MemorySessionStore) Load(id string) (*SessionState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.states[id], nil
+}
+
+// Remove will delete the state of the session with the specified id.
+func (s *MemorySessionStore) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.states, id)
+
+	return nil
+}
+
+// List will return the ids of all stored sessions.
+func (s *MemorySessionStore) List() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]string, 0, len(s.states))
+	for id := range s.states {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
 // ErrQueueFull is returned to a client that attempts two write to its own full
 // queue, which would result in a deadlock.
 var ErrQueueFull = errors.New("queue full")
@@ -65,6 +315,10 @@ var ErrQueueFull = errors.New("queue full")
 // ErrClosing is returned to a client if the backend is closing.
 var ErrClosing = errors.New("closing")
 
+// ErrClientNotFound is returned by Kick if no client with the specified id is
+// connected.
+var ErrClientNotFound = errors.New("client not found")
+
 // ErrKillTimeout is returned to a client if the existing client does not close
 // in time.
 var ErrKillTimeout = errors.New("kill timeout")
@@ -82,22 +336,95 @@ type MemoryBackend struct {
 	// Will default to 5 seconds.
 	KillTimeout time.Duration
 
+	// The maximal number of subscriptions per session, including shared
+	// subscriptions. Subscriptions that would exceed the limit are denied
+	// with the packet.QOSFailure return code. Replacing an existing
+	// subscription is always allowed. There is no limit if zero.
+	MaxSubscriptions int
+
 	// Client configuration options. See broker.Client for details.
 	ClientParallelPublishes  int
 	ClientParallelSubscribes int
 	ClientInflightMessages   int
 	ClientTokenTimeout       time.Duration
+	ClientPublishRate        float64
+	ClientPublishBurst       int
+	ClientWillDelay          time.Duration
+	ClientMaximumQOS         packet.QOS
+	ClientIdleTimeout        time.Duration
 
 	// A map of username and passwords that grant read and write access.
 	Credentials map[string]string
 
+	// If set, the common name of a verified client certificate is used as the
+	// user of the client. The Authenticator and RateLimiter are called with it
+	// and an eventual password that has been sent. Without an Authenticator,
+	// a verified certificate is sufficient to authenticate the client. See
+	// Client.Certificate for the required TLS configuration.
+	CertificateIdentity bool
+
+	// The Authenticator callback is called to authenticate connecting clients.
+	// If set, it takes precedence over the Credentials map. Returning false
+	// will deny the connection.
+	Authenticator func(clientID, user, password string) bool
+
+	// The RateLimiter callback is called for authenticated clients to obtain an
+	// individual publish rate and burst. If set, it takes precedence over
+	// ClientPublishRate and ClientPublishBurst. See broker.Client for details.
+	RateLimiter func(clientID, user string) (rate float64, burst int)
+
+	// The Authorizer is consulted for every publish and subscription. Denied
+	// subscriptions are acknowledged with a failure return code and denied
+	// messages are silently dropped. If not set, everything is allowed.
+	Authorizer Authorizer
+
+	// If set, clients that publish a denied message are disconnected instead.
+	CloseOnDeniedPublish bool
+
+	// The store used to keep retained messages.
+	//
+	// Will default to a MemoryRetainedStore.
+	Retained RetainedStore
+
+	// The store used to persist stored sessions. The state of a session is
+	// saved when its client goes offline and when the backend is closed. It is
+	// loaded when a client resumes a session that is not known to the backend,
+	// e.g. after a restart, or by LoadSessions.
+	//
+	// Note: Messages queued for offline clients are only persisted when the
+	// backend is closed.
+	//
+	// Will default to a MemorySessionStore.
+	Sessions SessionStore
+
+	// The interval in which broker metrics are published as retained messages
+	// to the "$SYS/broker/..." topics. Publishing starts with the first client
+	// setup and stops once the backend is closed. Disabled if zero.
+	SysInterval time.Duration
+
 	// The Logger callback handles incoming log events.
 	Logger func(LogEvent, *Client, packet.Generic, *packet.Message, error)
 
+	connections         uint64
+	activeConnections   int64
+	messagesReceived    uint64
+	messagesSent        uint64
+	messagesDropped     uint64
+	bytesSent           uint64
+	bytesReceived       uint64
+	sharedSubscriptions int64
+
 	activeClients     map[string]*Client
+	pendingWills      map[string]*Client
 	storedSessions    map[string]*memorySession
 	temporarySessions map[*Client]*memorySession
-	retainedMessages  *topic.Tree
+	subscriptions     *topic.Tree
+	sharedGroups      map[string]*sharedGroup
+	sharedFilters     *topic.Tree
+
+	started time.Time
+	sysOnce sync.Once
+	sysDone chan struct{}
 
 	globalMutex sync.Mutex
 	setupMutex  sync.Mutex
@@ -108,11 +435,19 @@ type MemoryBackend struct {
 func NewMemoryBackend() *MemoryBackend {
 	return &MemoryBackend{
 		SessionQueueSize:  100,
+		ClientMaximumQOS:  2,
 		KillTimeout:       5 * time.Second,
 		activeClients:     make(map[string]*Client),
+		pendingWills:      make(map[string]*Client),
 		storedSessions:    make(map[string]*memorySession),
 		temporarySessions: make(map[*Client]*memorySession),
-		retainedMessages:  topic.NewTree(),
+		subscriptions:     topic.NewTree(),
+		sharedGroups:      make(map[string]*sharedGroup),
+		sharedFilters:     topic.NewTree(),
+		Retained:          NewMemoryRetainedStore(),
+		Sessions:          NewMemorySessionStore(),
+		started:           time.Now(),
+		sysDone:           make(chan struct{}),
 	}
 }
 
@@ -127,17 +462,26 @@ func (m *MemoryBackend) Authenticate(client *Client, user, password string) (boo
 		return false, ErrClosing
 	}
 
-	// allow all if there are no credentials
-	if m.Credentials == nil {
-		return true, nil
+	// use certificate identity if available
+	cert := client.Certificate()
+	identified := m.CertificateIdentity && cert != nil
+	if identified {
+		user = cert.Subject.CommonName
 	}
 
-	// check login
-	if pw, ok := m.Credentials[user]; ok && pw == password {
-		return true, nil
+	// authenticate client, a verified certificate is sufficient if there is
+	// no authenticator
+	ok := identified && m.Authenticator == nil
+	if !ok {
+		ok = m.authenticate(client, user, password)
+	}
+
+	// apply rate limit if available
+	if ok && m.RateLimiter != nil {
+		client.PublishRate, client.PublishBurst = m.RateLimiter(client.ID(), user)
 	}
 
-	return false, nil
+	return ok, nil
 }
 
 // Setup will close existing clients and return an appropriate session.
@@ -155,11 +499,27 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 		return nil, false, ErrClosing
 	}
 
+	// start sys publisher if enabled
+	if m.SysInterval > 0 {
+		m.sysOnce.Do(func() {
+			go m.sysPublisher()
+		})
+	}
+
 	// apply client settings
 	client.ParallelPublishes = m.ClientParallelPublishes
 	client.ParallelSubscribes = m.ClientParallelSubscribes
 	client.InflightMessages = m.ClientInflightMessages
 	client.TokenTimeout = m.ClientTokenTimeout
+	client.WillDelay = m.ClientWillDelay
+	client.MaximumQOS = m.ClientMaximumQOS
+	client.IdleTimeout = m.ClientIdleTimeout
+
+	// apply default rate limit
+	if m.RateLimiter == nil {
+		client.PublishRate = m.ClientPublishRate
+		client.PublishBurst = m.ClientPublishBurst
+	}
 
 	// return a new temporary session if id is zero
 	if len(id) == 0 {
@@ -175,6 +535,12 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 
 	// client id is available
 
+	// discard delayed will of a previous client
+	if pendingClient, ok := m.pendingWills[id]; ok {
+		pendingClient.DiscardWill()
+		delete(m.pendingWills, id)
+	}
+
 	// retrieve existing client
 	existingSession, ok := m.storedSessions[id]
 	if !ok {
@@ -185,8 +551,11 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 
 	// kill existing client if session is taken
 	if ok && existingSession.owner != nil {
-		// close client
-		existingSession.owner.Close()
+		// get owner as the field is reset once the client terminates
+		existingClient := existingSession.owner
+
+		// close client without publishing its will as the session is taken over
+		existingClient.CloseWithoutWill()
 
 		// release global mutex to allow publish and termination, but leave the
 		// setup mutex to prevent setups
@@ -195,7 +564,7 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 		// wait for client to close
 		var err error
 		select {
-		case <-existingSession.owner.Closed():
+		case <-existingClient.Closed():
 			// continue
 		case <-time.After(m.KillTimeout):
 			err = ErrKillTimeout
@@ -214,7 +583,17 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 	// session is requested
 	if clean {
 		// delete any stored session
-		delete(m.storedSessions, id)
+		if storedSession, ok := m.storedSessions[id]; ok {
+			m.subscriptions.Clear(storedSession)
+			m.removeShared(storedSession)
+			delete(m.storedSessions, id)
+		}
+
+		// remove any persisted session
+		err := m.Sessions.Remove(id)
+		if err != nil {
+			return nil, false, err
+		}
 
 		// create new session
 		sess := newMemorySession(m.SessionQueueSize)
@@ -229,8 +608,19 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 		return sess, false, nil
 	}
 
-	// attempt to reuse a stored session
+	// attempt to restore a persisted session
 	storedSession, ok := m.storedSessions[id]
+	if !ok {
+		var err error
+		storedSession, err = m.loadSession(id)
+		if err != nil {
+			return nil, false, err
+		}
+
+		ok = storedSession != nil
+	}
+
+	// attempt to reuse a stored session
 	if ok {
 		// reuse session
 		storedSession.reuse()
@@ -255,6 +645,40 @@ func (m *MemoryBackend) Setup(client *Client, id string, clean bool) (Session, b
 	return storedSession, false, nil
 }
 
+// LoadSessions will load all sessions from the session store that are not yet
+// known to the backend. It should be called on startup to have offline
+// sessions receive messages before their clients reconnect.
+func (m *MemoryBackend) LoadSessions() error {
+	// acquire global mutex
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	// return error if closing
+	if m.closing {
+		return ErrClosing
+	}
+
+	// get ids
+	ids, err := m.Sessions.List()
+	if err != nil {
+		return err
+	}
+
+	// load unknown sessions
+	for _, id := range ids {
+		if _, ok := m.storedSessions[id]; ok {
+			continue
+		}
+
+		_, err = m.loadSession(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Restore is not needed at the moment.
 func (m *MemoryBackend) Restore(client *Client) error {
 	return nil
@@ -266,9 +690,41 @@ func (m *MemoryBackend) Subscribe(client *Client, subs []packet.Subscription, ac
 	m.globalMutex.Lock()
 	defer m.globalMutex.Unlock()
 
+	// get subscription count
+	var count int
+	if m.MaxSubscriptions > 0 {
+		count = m.countSubscriptions(client.Session().(*memorySession))
+	}
+
 	// save subscription
-	for _, sub := range subs {
+	for i, sub := range subs {
+		// deny unauthorized subscriptions
+		if m.Authorizer != nil && !m.Authorizer.CanSubscribe(client.ID(), sub.Topic) {
+			subs[i].QOS = packet.QOSFailure
+			continue
+		}
+
+		// deny new subscriptions above the limit
+		if m.MaxSubscriptions > 0 && !m.subscribed(client.Session().(*memorySession), sub.Topic) {
+			if count >= m.MaxSubscriptions {
+				subs[i].QOS = packet.QOSFailure
+				continue
+			}
+
+			count++
+		}
+
+		// handle shared subscriptions
+		if strings.HasPrefix(sub.Topic, "$share/") {
+			if !m.joinShared(client.Session().(*memorySession), sub) {
+				subs[i].QOS = packet.QOSFailure
+			}
+
+			continue
+		}
+
 		client.Session().(*memorySession).subscriptions.Set(sub.Topic, sub)
+		m.subscriptions.Add(sub.Topic, client.Session().(*memorySession))
 	}
 
 	// call ack if provided
@@ -281,14 +737,22 @@ func (m *MemoryBackend) Subscribe(client *Client, subs []packet.Subscription, ac
 
 	// handle all subscriptions
 	for _, sub := range subs {
+		// skip denied and shared subscriptions
+		if sub.QOS == packet.QOSFailure || strings.HasPrefix(sub.Topic, "$share/") {
+			continue
+		}
+
 		// get retained messages
-		values := m.retainedMessages.Search(sub.Topic)
+		msgs, err := m.Retained.Search(sub.Topic)
+		if err != nil {
+			return err
+		}
 
 		// publish messages
-		for _, value := range values {
+		for _, msg := range msgs {
 			// add to temporary queue or return error if queue is full
 			select {
-			case sess.temporary <- value.(*packet.Message):
+			case sess.temporary <- msg:
 			default:
 				return ErrQueueFull
 			}
@@ -300,9 +764,20 @@ func (m *MemoryBackend) Subscribe(client *Client, subs []packet.Subscription, ac
 
 // Unsubscribe will delete the subscription.
 func (m *MemoryBackend) Unsubscribe(client *Client, topics []string, ack Ack) error {
+	// acquire global mutex
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
 	// delete subscriptions
 	for _, t := range topics {
+		// handle shared subscriptions
+		if strings.HasPrefix(t, "$share/") {
+			m.leaveShared(client.Session().(*memorySession), t)
+			continue
+		}
+
 		client.Session().(*memorySession).subscriptions.Empty(t)
+		m.subscriptions.Remove(t, client.Session().(*memorySession))
 	}
 
 	// call ack if provided
@@ -323,14 +798,43 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 	// publish. clients that stay connected but won't drain their queue will
 	// eventually deadlock the broker
 
+	// forget client if its delayed will is published
+	if m.pendingWills[client.ID()] == client {
+		delete(m.pendingWills, client.ID())
+	}
+
+	// check authorization
+	if m.Authorizer != nil && !m.Authorizer.CanPublish(client.ID(), msg.Topic) {
+		if m.CloseOnDeniedPublish {
+			return ErrNotAuthorized
+		}
+
+		// drop message
+		atomic.AddUint64(&m.messagesDropped, 1)
+		if ack != nil {
+			ack()
+		}
+
+		return nil
+	}
+
+	// count message
+	atomic.AddUint64(&m.messagesReceived, 1)
+
 	// check retain flag
 	if msg.Retain {
 		if len(msg.Payload) > 0 {
 			// retain message
-			m.retainedMessages.Set(msg.Topic, msg.Copy())
+			err := m.Retained.Store(msg.Copy())
+			if err != nil {
+				return err
+			}
 		} else {
 			// clear already retained message
-			m.retainedMessages.Empty(msg.Topic)
+			err := m.Retained.Clear(msg.Topic)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -349,50 +853,68 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 	// reset retained flag
 	msg.Retain = false
 
-	// add message to temporary sessions
-	for _, sess := range m.temporarySessions {
-		if sub := sess.lookupSubscription(msg.Topic); sub != nil {
-			if sess.owner == client {
-				// detect deadlock when adding to own queue
-				select {
-				case queue(sess) <- msg:
-				default:
-					return ErrQueueFull
-				}
-			} else {
-				// wait for room since client is online
-				select {
-				case queue(sess) <- msg:
-				case <-sess.owner.Closed():
-				case <-client.Closed():
-				}
+	// add message to all sessions with a matching subscription
+	for _, value := range m.subscriptions.Match(msg.Topic) {
+		sess := value.(*memorySession)
+
+		if sess.owner == client {
+			// detect deadlock when adding to own queue
+			select {
+			case queue(sess) <- msg:
+			default:
+				return ErrQueueFull
+			}
+		} else if sess.owner != nil {
+			// wait for room if client is online
+			if !offer(queue(sess), msg, sess.owner, client) {
+				atomic.AddUint64(&m.messagesDropped, 1)
+			}
+		} else {
+			// ignore message if stored queue is full
+			select {
+			case queue(sess) <- msg:
+			default:
+				atomic.AddUint64(&m.messagesDropped, 1)
 			}
 		}
 	}
 
-	// add message to stored sessions
-	for _, sess := range m.storedSessions {
-		if sub := sess.lookupSubscription(msg.Topic); sub != nil {
-			if sess.owner == client {
-				// detect deadlock when adding to own queue
-				select {
-				case queue(sess) <- msg:
-				default:
-					return ErrQueueFull
-				}
-			} else if sess.owner != nil {
-				// wait for room if client is online
-				select {
-				case queue(sess) <- msg:
-				case <-sess.owner.Closed():
-				case <-client.Closed():
-				}
-			} else {
-				// ignore message if stored queue is full
-				select {
-				case queue(sess) <- msg:
-				default:
-				}
+	// add message to one member of every matching shared group
+	for _, value := range m.sharedFilters.Match(msg.Topic) {
+		// select member
+		sess, sub := value.(*sharedGroup).pick()
+
+		// respect maximum qos
+		shared := msg
+		if shared.QOS > sub.QOS {
+			shared = msg.Copy()
+			shared.QOS = sub.QOS
+		}
+
+		// select queue
+		queue := sess.temporary
+		if shared.QOS > 0 {
+			queue = sess.stored
+		}
+
+		if sess.owner == client {
+			// detect deadlock when adding to own queue
+			select {
+			case queue <- shared:
+			default:
+				return ErrQueueFull
+			}
+		} else if sess.owner != nil {
+			// wait for room if client is online
+			if !offer(queue, shared, sess.owner, client) {
+				atomic.AddUint64(&m.messagesDropped, 1)
+			}
+		} else {
+			// ignore message if queue is full
+			select {
+			case queue <- shared:
+			default:
+				atomic.AddUint64(&m.messagesDropped, 1)
 			}
 		}
 	}
@@ -405,6 +927,28 @@ func (m *MemoryBackend) Publish(client *Client, msg *packet.Message, ack Ack) er
 	return nil
 }
 
+// adds the message to the queue and waits for room until the owner or the
+// publishing client closes
+func offer(queue chan *packet.Message, msg *packet.Message, owner, client *Client) bool {
+	// try without waiting first as the publishing client is already closed
+	// when a delayed will is published
+	select {
+	case queue <- msg:
+		return true
+	default:
+	}
+
+	// wait for room
+	select {
+	case queue <- msg:
+		return true
+	case <-owner.Closed():
+		return false
+	case <-client.Closed():
+		return false
+	}
+}
+
 // Dequeue will get the next message from the temporary or stored queue.
 func (m *MemoryBackend) Dequeue(client *Client) (*packet.Message, Ack, error) {
 	// mutex locking not needed
@@ -418,8 +962,10 @@ func (m *MemoryBackend) Dequeue(client *Client) (*packet.Message, Ack, error) {
 	// get next message from queue
 	select {
 	case msg := <-sess.temporary:
+		atomic.AddUint64(&m.messagesSent, 1)
 		return sess.applyQOS(msg), nil, nil
 	case msg := <-sess.stored:
+		atomic.AddUint64(&m.messagesSent, 1)
 		return sess.applyQOS(msg), nil, nil
 	case <-client.Closing():
 		return nil, nil, nil
@@ -438,29 +984,398 @@ func (m *MemoryBackend) Terminate(client *Client) error {
 		sess.owner = nil
 	}
 
+	// persist stored session
+	if ok && sess != nil && m.storedSessions[client.ID()] == sess {
+		err := m.saveSession(client.ID(), sess)
+		if err != nil {
+			return err
+		}
+	}
+
+	// remove subscriptions of temporary sessions
+	if tempSess, ok := m.temporarySessions[client]; ok {
+		m.subscriptions.Clear(tempSess)
+		m.removeShared(tempSess)
+	}
+
 	// remove any temporary session
 	delete(m.temporarySessions, client)
 
+	// remember client if its will is delayed
+	if client.WillDelay > 0 && client.ID() != "" && client.will != nil && atomic.LoadUint32(&client.discardWill) == 0 {
+		m.pendingWills[client.ID()] = client
+	}
+
 	// remove any saved client
 	delete(m.activeClients, client.ID())
 
 	return nil
 }
 
+func (m *MemoryBackend) authenticate(client *Client, user, password string) bool {
+	// use authenticator if available
+	if m.Authenticator != nil {
+		return m.Authenticator(client.ID(), user, password)
+	}
+
+	// allow all if there are no credentials
+	if m.Credentials == nil {
+		return true
+	}
+
+	// check login
+	if pw, ok := m.Credentials[user]; ok && pw == password {
+		return true
+	}
+
+	return false
+}
+
+// saves the state of the stored session
+func (m *MemoryBackend) saveSession(id string, sess *memorySession) error {
+	// prepare state
+	state := &SessionState{
+		Messages: sess.queued(),
+	}
+
+	// get subscriptions
+	for _, value := range sess.subscriptions.All() {
+		state.Subscriptions = append(state.Subscriptions, value.(packet.Subscription))
+	}
+
+	// get shared subscriptions
+	for _, group := range m.sharedGroups {
+		if sub, ok := group.members[sess]; ok {
+			state.Subscriptions = append(state.Subscriptions, sub)
+		}
+	}
+
+	// get packets
+	var err error
+	state.Incoming, err = sess.AllPackets(session.Incoming)
+	if err != nil {
+		return err
+	}
+	state.Outgoing, err = sess.AllPackets(session.Outgoing)
+	if err != nil {
+		return err
+	}
+
+	return m.Sessions.Save(id, state)
+}
+
+// loads and registers a persisted session, returns nil if there is none
+func (m *MemoryBackend) loadSession(id string) (*memorySession, error) {
+	// load state
+	state, err := m.Sessions.Load(id)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	// create session
+	sess := newMemorySession(m.SessionQueueSize)
+
+	// restore subscriptions
+	for _, sub := range state.Subscriptions {
+		if strings.HasPrefix(sub.Topic, "$share/") {
+			m.joinShared(sess, sub)
+			continue
+		}
+
+		sess.subscriptions.Set(sub.Topic, sub)
+		m.subscriptions.Add(sub.Topic, sess)
+	}
+
+	// restore packets
+	for _, pkt := range state.Incoming {
+		err = sess.SavePacket(session.Incoming, pkt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pkt := range state.Outgoing {
+		err = sess.SavePacket(session.Outgoing, pkt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// restore messages, ignore messages if the queue is full
+	for _, msg := range state.Messages {
+		select {
+		case sess.stored <- msg:
+		default:
+		}
+	}
+
+	// save session
+	m.storedSessions[id] = sess
+
+	return sess, nil
+}
+
+// adds the session to the shared group and returns false if the topic is not
+// a valid shared subscription
+func (m *MemoryBackend) joinShared(sess *memorySession, sub packet.Subscription) bool {
+	// parse topic
+	_, filter, ok := parseShared(sub.Topic)
+	if !ok {
+		return false
+	}
+
+	// get or create group
+	group, ok := m.sharedGroups[sub.Topic]
+	if !ok {
+		group = &sharedGroup{
+			filter:  filter,
+			members: make(map[*memorySession]packet.Subscription),
+		}
+
+		m.sharedGroups[sub.Topic] = group
+		m.sharedFilters.Add(filter, group)
+	}
+
+	// add member
+	if _, ok := group.members[sess]; !ok {
+		atomic.AddInt64(&m.sharedSubscriptions, 1)
+	}
+	group.members[sess] = sub
+
+	return true
+}
+
+// returns the number of subscriptions and shared subscriptions of the session
+func (m *MemoryBackend) countSubscriptions(sess *memorySession) int {
+	// count subscriptions
+	count := sess.subscriptions.Count()
+
+	// count shared subscriptions
+	for _, group := range m.sharedGroups {
+		if _, ok := group.members[sess]; ok {
+			count++
+		}
+	}
+
+	return count
+}
+
+// returns whether the session has a subscription or shared subscription with
+// the specified topic filter
+func (m *MemoryBackend) subscribed(sess *memorySession, t string) bool {
+	// check shared subscriptions
+	if strings.HasPrefix(t, "$share/") {
+		group, ok := m.sharedGroups[t]
+		if !ok {
+			return false
+		}
+
+		_, ok = group.members[sess]
+		return ok
+	}
+
+	return len(sess.subscriptions.Get(t)) > 0
+}
+
+// removes the session from the shared group
+func (m *MemoryBackend) leaveShared(sess *memorySession, t string) {
+	// get group
+	group, ok := m.sharedGroups[t]
+	if !ok {
+		return
+	}
+
+	// remove member
+	if _, ok := group.members[sess]; ok {
+		atomic.AddInt64(&m.sharedSubscriptions, -1)
+	}
+	delete(group.members, sess)
+
+	// remove empty group
+	if len(group.members) == 0 {
+		delete(m.sharedGroups, t)
+		m.sharedFilters.Remove(group.filter, group)
+	}
+}
+
+// removes the session from all shared groups
+func (m *MemoryBackend) removeShared(sess *memorySession) {
+	for t := range m.sharedGroups {
+		m.leaveShared(sess, t)
+	}
+}
+
+// Clients will return the ids of all currently connected clients. Clients that
+// connected with a zero length id are not included.
+func (m *MemoryBackend) Clients() []string {
+	// acquire global mutex
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	// collect ids
+	ids := make([]string, 0, len(m.activeClients))
+	for id := range m.activeClients {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Kick will immediately close the connection of the client with the specified
+// id. As no Disconnect has been received, an eventual will message will be
+// published.
+func (m *MemoryBackend) Kick(id string) error {
+	// acquire global mutex
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	// get client
+	client, ok := m.activeClients[id]
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	// close client
+	client.Close()
+
+	return nil
+}
+
+// publishes the broker metrics until the backend is closed
+func (m *MemoryBackend) sysPublisher() {
+	// create ticker
+	ticker := time.NewTicker(m.SysInterval)
+	defer ticker.Stop()
+
+	for {
+		// publish metrics
+		m.publishSys()
+
+		// wait for next tick
+		select {
+		case <-ticker.C:
+		case <-m.sysDone:
+			return
+		}
+	}
+}
+
+// retains and queues the current broker metrics
+func (m *MemoryBackend) publishSys() {
+	// acquire global mutex
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	// count connected clients
+	connected := len(m.temporarySessions)
+	for _, sess := range m.storedSessions {
+		if sess.owner != nil {
+			connected++
+		}
+	}
+
+	// count subscriptions
+	subscriptions := m.subscriptions.Count()
+	for _, group := range m.sharedGroups {
+		subscriptions += len(group.members)
+	}
+
+	// prepare metrics
+	metrics := []struct {
+		topic string
+		value int64
+	}{
+		{"$SYS/broker/clients/connected", int64(connected)},
+		{"$SYS/broker/messages/received", int64(atomic.LoadUint64(&m.messagesReceived))},
+		{"$SYS/broker/messages/sent", int64(atomic.LoadUint64(&m.messagesSent))},
+		{"$SYS/broker/uptime", int64(time.Since(m.started) / time.Second)},
+		{"$SYS/broker/subscriptions/count", int64(subscriptions)},
+	}
+
+	for _, metric := range metrics {
+		msg := &packet.Message{
+			Topic:   metric.topic,
+			Payload: []byte(strconv.FormatInt(metric.value, 10)),
+			Retain:  true,
+		}
+
+		// retain message
+		err := m.Retained.Store(msg.Copy())
+		if err != nil {
+			m.Log(BackendError, nil, nil, msg, err)
+		}
+
+		// reset retained flag
+		msg.Retain = false
+
+		// add message to all sessions with a matching subscription but ignore
+		// sessions with a full queue
+		for _, value := range m.subscriptions.Match(msg.Topic) {
+			select {
+			case value.(*memorySession).temporary <- msg:
+			default:
+			}
+		}
+	}
+}
+
 // Log will call the associated logger.
 func (m *MemoryBackend) Log(event LogEvent, client *Client, pkt packet.Generic, msg *packet.Message, err error) {
+	// update metrics
+	switch event {
+	case NewConnection:
+		atomic.AddUint64(&m.connections, 1)
+		atomic.AddInt64(&m.activeConnections, 1)
+	case LostConnection:
+		atomic.AddInt64(&m.activeConnections, -1)
+	case PacketReceived:
+		atomic.AddUint64(&m.bytesReceived, uint64(pkt.Len()))
+	case PacketSent:
+		atomic.AddUint64(&m.bytesSent, uint64(pkt.Len()))
+	}
+
 	// call logger if available
 	if m.Logger != nil {
 		m.Logger(event, client, pkt, msg, err)
 	}
 }
 
-// Close will close all active clients and close the backend. The return value
-// denotes if the timeout has been reached.
+// Metrics returns a snapshot of the backend metrics. The counters are read
+// without acquiring the global mutex and may therefore be slightly
+// inconsistent with each other.
+func (m *MemoryBackend) Metrics() Metrics {
+	// get counters
+	metrics := Metrics{
+		Connections:       atomic.LoadUint64(&m.connections),
+		ActiveConnections: atomic.LoadInt64(&m.activeConnections),
+		MessagesReceived:  atomic.LoadUint64(&m.messagesReceived),
+		MessagesSent:      atomic.LoadUint64(&m.messagesSent),
+		MessagesDropped:   atomic.LoadUint64(&m.messagesDropped),
+		Subscriptions:     m.subscriptions.Count() + int(atomic.LoadInt64(&m.sharedSubscriptions)),
+		BytesSent:         atomic.LoadUint64(&m.bytesSent),
+		BytesReceived:     atomic.LoadUint64(&m.bytesReceived),
+	}
+
+	// count retained messages if supported
+	if counter, ok := m.Retained.(interface{ Count() int }); ok {
+		metrics.Retained = counter.Count()
+	}
+
+	return metrics
+}
+
+// Close will close all active clients and close the backend. Delayed will
+// messages that have not yet been published are discarded. The state of all
+// stored sessions is saved to the session store once the clients have closed.
+// The return value denotes if the timeout has been reached.
 func (m *MemoryBackend) Close(timeout time.Duration) bool {
 	// acquire global mutex
 	m.globalMutex.Lock()
 
+	// stop sys publisher
+	if !m.closing {
+		close(m.sysDone)
+	}
+
 	// set closing
 	m.closing = true
 
@@ -484,11 +1399,6 @@ func (m *MemoryBackend) Close(timeout time.Duration) bool {
 	// release mutex to allow termination
 	m.globalMutex.Unlock()
 
-	// return early if empty
-	if len(clients) == 0 {
-		return true
-	}
-
 	// prepare timeout
 	tm := time.After(timeout)
 
@@ -502,5 +1412,25 @@ func (m *MemoryBackend) Close(timeout time.Duration) bool {
 		}
 	}
 
+	// acquire global mutex
+	m.globalMutex.Lock()
+	defer m.globalMutex.Unlock()
+
+	// discard delayed wills
+	for id, client := range m.pendingWills {
+		client.DiscardWill()
+		delete(m.pendingWills, id)
+	}
+
+	// persist offline stored sessions
+	for id, sess := range m.storedSessions {
+		if sess.owner == nil {
+			err := m.saveSession(id, sess)
+			if err != nil {
+				m.Log(BackendError, nil, nil, nil, err)
+			}
+		}
+	}
+
 	return true
 }
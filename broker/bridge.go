@@ -0,0 +1,316 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/topic"
+	"github.com/256dpi/gomqtt/transport"
+)
+
+// A BridgeDirection defines in which direction messages are forwarded.
+type BridgeDirection int
+
+const (
+	// BridgeIn forwards messages from the remote to the local broker.
+	BridgeIn BridgeDirection = iota
+
+	// BridgeOut forwards messages from the local to the remote broker.
+	BridgeOut
+
+	// BridgeBoth forwards messages in both directions.
+	BridgeBoth
+)
+
+// A BridgeTopic defines a topic filter that is bridged.
+type BridgeTopic struct {
+	// The topic filter that is subscribed.
+	Filter string
+
+	// The QOS level used for the subscription.
+	QOS packet.QOS
+
+	// The direction in which matching messages are forwarded.
+	Direction BridgeDirection
+}
+
+// A BridgeConfig holds information about bridging messages between the local
+// and a remote broker.
+type BridgeConfig struct {
+	// The configuration used to connect to the remote broker.
+	Remote *client.Config
+
+	// The client id used for the local connection. A temporary session is used
+	// if empty.
+	LocalClientID string
+
+	// The topics that are bridged.
+	Topics []BridgeTopic
+
+	// The time a message forwarded in both directions is expected to be
+	// received back from the other broker. Messages that arrive later are
+	// forwarded again as they cannot be told apart from new messages.
+	//
+	// Will default to 10 seconds.
+	EchoTimeout time.Duration
+
+	// OnError can be used to receive errors from the local and remote
+	// connection. The bridge will automatically reconnect in both cases.
+	OnError func(error)
+}
+
+// A Bridge forwards messages between the local engine and a remote broker.
+// Both connections are managed by a client.Service and reconnect independently
+// of each other and of the local clients.
+//
+// Messages that are bridged in both directions are not forwarded back to the
+// broker they have been received from. To detect them, the bridge remembers a
+// hash of the topic and payload of every such message until it has been
+// received back or BridgeConfig.EchoTimeout has passed.
+type Bridge struct {
+	config BridgeConfig
+
+	local  *client.Service
+	remote *client.Service
+
+	inFilters  *topic.Tree
+	outFilters *topic.Tree
+
+	localOnline  uint32
+	remoteOnline uint32
+
+	localEchoes  *echoList
+	remoteEchoes *echoList
+	mutex        sync.Mutex
+}
+
+// AddBridge creates and starts a bridge between the engine and the remote broker
+// specified in the config. The local connection is handled by the engine
+// directly using a transport.Pipe.
+//
+// Note: The bridge should be stopped before the engine is closed.
+func (e *Engine) AddBridge(config BridgeConfig) *Bridge {
+	// check config
+	if config.Remote == nil {
+		panic("no remote config specified")
+	}
+
+	// set default echo timeout
+	if config.EchoTimeout == 0 {
+		config.EchoTimeout = 10 * time.Second
+	}
+
+	// prepare bridge
+	b := &Bridge{
+		config:       config,
+		local:        client.NewService(),
+		remote:       client.NewService(),
+		inFilters:    topic.NewTree(),
+		outFilters:   topic.NewTree(),
+		localEchoes:  newEchoList(config.EchoTimeout),
+		remoteEchoes: newEchoList(config.EchoTimeout),
+	}
+
+	// prepare subscriptions
+	var inSubs, outSubs []packet.Subscription
+	for _, t := range config.Topics {
+		sub := packet.Subscription{Topic: t.Filter, QOS: t.QOS}
+
+		if t.Direction == BridgeIn || t.Direction == BridgeBoth {
+			b.inFilters.Add(t.Filter, t)
+			inSubs = append(inSubs, sub)
+		}
+
+		if t.Direction == BridgeOut || t.Direction == BridgeBoth {
+			b.outFilters.Add(t.Filter, t)
+			outSubs = append(outSubs, sub)
+		}
+	}
+
+	// prepare local config
+	local := client.NewConfigWithClientID("pipe://bridge", config.LocalClientID)
+	local.AllowLongClientID = true
+	local.Dialer = client.DialerFunc(func(string) (transport.Conn, error) {
+		conn1, conn2 := transport.Pipe()
+		if !e.Handle(conn2) {
+			return nil, ErrClosing
+		}
+
+		return conn1, nil
+	})
+
+	// configure services
+	b.configure(b.local, &b.localOnline, func(msg *packet.Message) {
+		b.forward(msg, b.remote, b.outFilters, b.inFilters, b.localEchoes, b.remoteEchoes)
+	})
+	b.configure(b.remote, &b.remoteOnline, func(msg *packet.Message) {
+		b.forward(msg, b.local, b.inFilters, b.outFilters, b.remoteEchoes, b.localEchoes)
+	})
+
+	// queue subscriptions, they are sent again on every reconnect
+	if len(outSubs) > 0 {
+		b.local.SubscribeMultiple(outSubs)
+	}
+	if len(inSubs) > 0 {
+		b.remote.SubscribeMultiple(inSubs)
+	}
+
+	// start services
+	b.local.Start(local)
+	b.remote.Start(config.Remote)
+
+	return b
+}
+
+// Online returns whether the local and remote connection are established and
+// all subscriptions have been acknowledged.
+func (b *Bridge) Online() bool {
+	return atomic.LoadUint32(&b.localOnline) == 1 && atomic.LoadUint32(&b.remoteOnline) == 1
+}
+
+// Stop will disconnect the bridge from the local and remote broker.
+func (b *Bridge) Stop() {
+	b.remote.Stop(true)
+	b.local.Stop(true)
+}
+
+func (b *Bridge) configure(s *client.Service, online *uint32, handler func(*packet.Message)) {
+	s.OnlineCallback = func(bool) {
+		atomic.StoreUint32(online, 1)
+	}
+
+	s.OfflineCallback = func() {
+		atomic.StoreUint32(online, 0)
+	}
+
+	s.ErrorCallback = func(err error) {
+		if b.config.OnError != nil {
+			b.config.OnError(err)
+		}
+	}
+
+	s.MessageCallback = func(msg *packet.Message) error {
+		handler(msg)
+		return nil
+	}
+}
+
+// forwards a message received from one side using the service of the other side
+func (b *Bridge) forward(msg *packet.Message, to *client.Service, filters, reverse *topic.Tree, echoes, reverseEchoes *echoList) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// get key and time
+	key := echoKey(msg)
+	now := time.Now()
+
+	// drop message if it has been forwarded by the bridge
+	if echoes.consume(key, now) {
+		return
+	}
+
+	// check if the message is bridged in this direction
+	if filters.MatchFirst(msg.Topic) == nil {
+		return
+	}
+
+	// remember message if it will be received again by the other side
+	if reverse.MatchFirst(msg.Topic) != nil {
+		reverseEchoes.add(key, now)
+	}
+
+	// forward message
+	to.PublishMessage(msg.Copy())
+}
+
+// an echo is a forwarded message that is expected to be received back
+type echo struct {
+	key      [sha256.Size]byte
+	deadline time.Time
+	done     bool
+}
+
+// an echoList holds the expected echoes in the order they have been added
+type echoList struct {
+	timeout time.Duration
+	keys    map[[sha256.Size]byte][]*echo
+	queue   []*echo
+}
+
+func newEchoList(timeout time.Duration) *echoList {
+	return &echoList{
+		timeout: timeout,
+		keys:    make(map[[sha256.Size]byte][]*echo),
+	}
+}
+
+// add will add an echo with the specified key
+func (l *echoList) add(key [sha256.Size]byte, now time.Time) {
+	// remove expired echoes
+	l.expire(now)
+
+	// add echo
+	e := &echo{key: key, deadline: now.Add(l.timeout)}
+	l.keys[key] = append(l.keys[key], e)
+	l.queue = append(l.queue, e)
+}
+
+// consume will return whether an echo with the specified key has been removed
+func (l *echoList) consume(key [sha256.Size]byte, now time.Time) bool {
+	// remove expired echoes
+	l.expire(now)
+
+	// get oldest echo
+	list := l.keys[key]
+	if len(list) == 0 {
+		return false
+	}
+
+	// mark and remove echo, it stays in the queue until it expires
+	list[0].done = true
+	l.remove(key)
+
+	return true
+}
+
+func (l *echoList) expire(now time.Time) {
+	// all echoes have the same timeout and the queue is therefore ordered by
+	// deadline
+	for len(l.queue) > 0 && !now.Before(l.queue[0].deadline) {
+		e := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+
+		// remove echo if not yet consumed, it is the oldest of its key
+		if !e.done {
+			l.remove(e.key)
+		}
+	}
+}
+
+func (l *echoList) remove(key [sha256.Size]byte) {
+	list := l.keys[key]
+	if len(list) <= 1 {
+		delete(l.keys, key)
+		return
+	}
+
+	list[0] = nil
+	l.keys[key] = list[1:]
+}
+
+func echoKey(msg *packet.Message) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(msg.Topic))
+	h.Write([]byte{0})
+	h.Write(msg.Payload)
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	return key
+}
@@ -0,0 +1,209 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBridge(t *testing.T) {
+	localEngine := NewEngine(NewMemoryBackend())
+	localPort, localQuit, localDone := Run(localEngine, "tcp")
+
+	remotePort, remoteQuit, remoteDone := Run(NewEngine(NewMemoryBackend()), "tcp")
+
+	bridge := localEngine.AddBridge(BridgeConfig{
+		Remote: client.NewConfig("tcp://localhost:" + remotePort),
+		Topics: []BridgeTopic{
+			{Filter: "in/#", Direction: BridgeIn},
+			{Filter: "out/#", Direction: BridgeOut},
+			{Filter: "both/#", Direction: BridgeBoth},
+		},
+	})
+
+	for !bridge.Online() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	localMessages := make(chan string, 10)
+	remoteMessages := make(chan string, 10)
+
+	connect := func(port string, messages chan string) *client.Client {
+		c := client.New()
+		c.Callback = func(msg *packet.Message, err error) error {
+			assert.NoError(t, err)
+			messages <- msg.Topic
+			return nil
+		}
+
+		cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Wait(10*time.Second))
+
+		sf, err := c.Subscribe("#", 0)
+		assert.NoError(t, err)
+		assert.NoError(t, sf.Wait(10*time.Second))
+
+		return c
+	}
+
+	localClient := connect(localPort, localMessages)
+	remoteClient := connect(remotePort, remoteMessages)
+
+	publish := func(c *client.Client, topic string) {
+		pf, err := c.Publish(topic, []byte(topic), 0, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	// remote to local
+	publish(remoteClient, "in/foo")
+	assert.Equal(t, "in/foo", <-remoteMessages)
+	assert.Equal(t, "in/foo", <-localMessages)
+
+	// local to remote
+	publish(localClient, "out/foo")
+	assert.Equal(t, "out/foo", <-localMessages)
+	assert.Equal(t, "out/foo", <-remoteMessages)
+
+	// not forwarded
+	publish(localClient, "in/bar")
+	publish(remoteClient, "out/bar")
+	assert.Equal(t, "in/bar", <-localMessages)
+	assert.Equal(t, "out/bar", <-remoteMessages)
+
+	// both directions without echoes
+	publish(localClient, "both/foo")
+	assert.Equal(t, "both/foo", <-localMessages)
+	assert.Equal(t, "both/foo", <-remoteMessages)
+	publish(remoteClient, "both/bar")
+	assert.Equal(t, "both/bar", <-remoteMessages)
+	assert.Equal(t, "both/bar", <-localMessages)
+
+	// flush
+	publish(localClient, "out/baz")
+	assert.Equal(t, "out/baz", <-localMessages)
+	assert.Equal(t, "out/baz", <-remoteMessages)
+	publish(remoteClient, "in/baz")
+	assert.Equal(t, "in/baz", <-remoteMessages)
+	assert.Equal(t, "in/baz", <-localMessages)
+
+	assert.Empty(t, localMessages)
+	assert.Empty(t, remoteMessages)
+
+	assert.NoError(t, localClient.Disconnect())
+	assert.NoError(t, remoteClient.Disconnect())
+
+	bridge.Stop()
+
+	close(localQuit)
+	close(remoteQuit)
+
+	safeReceive(localDone)
+	safeReceive(remoteDone)
+}
+
+type bridgeAuthorizer struct{}
+
+func (bridgeAuthorizer) CanPublish(clientID, topic string) bool {
+	return clientID != "bridge" || topic != "both/denied"
+}
+
+func (bridgeAuthorizer) CanSubscribe(clientID, filter string) bool {
+	return true
+}
+
+func TestBridgeMissingEcho(t *testing.T) {
+	localEngine := NewEngine(NewMemoryBackend())
+	localPort, localQuit, localDone := Run(localEngine, "tcp")
+
+	remoteBackend := NewMemoryBackend()
+	remoteBackend.Authorizer = bridgeAuthorizer{}
+	remotePort, remoteQuit, remoteDone := Run(NewEngine(remoteBackend), "tcp")
+
+	bridge := localEngine.AddBridge(BridgeConfig{
+		Remote: client.NewConfigWithClientID("tcp://localhost:"+remotePort, "bridge"),
+		Topics: []BridgeTopic{
+			{Filter: "both/#", Direction: BridgeBoth},
+		},
+		EchoTimeout: 100 * time.Millisecond,
+	})
+
+	for !bridge.Online() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	localMessages := make(chan string, 10)
+
+	localClient := client.New()
+	localClient.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		localMessages <- msg.Topic
+		return nil
+	}
+
+	cf, err := localClient.Connect(client.NewConfig("tcp://localhost:" + localPort))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := localClient.Subscribe("#", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	remoteClient := client.New()
+	cf, err = remoteClient.Connect(client.NewConfig("tcp://localhost:" + remotePort))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	// the forwarded message is denied and never echoed
+	pf, err := localClient.Publish("both/denied", []byte("test"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+	assert.Equal(t, "both/denied", <-localMessages)
+
+	// wait for echo to expire
+	time.Sleep(200 * time.Millisecond)
+
+	// the same message from the remote is forwarded
+	pf, err = remoteClient.Publish("both/denied", []byte("test"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+	assert.Equal(t, "both/denied", <-localMessages)
+
+	assert.NoError(t, localClient.Disconnect())
+	assert.NoError(t, remoteClient.Disconnect())
+
+	bridge.Stop()
+
+	close(localQuit)
+	close(remoteQuit)
+
+	safeReceive(localDone)
+	safeReceive(remoteDone)
+}
+
+func TestEchoList(t *testing.T) {
+	list := newEchoList(time.Second)
+	now := time.Now()
+
+	key1 := echoKey(&packet.Message{Topic: "foo", Payload: []byte("1")})
+	key2 := echoKey(&packet.Message{Topic: "foo", Payload: []byte("2")})
+
+	list.add(key1, now)
+	list.add(key1, now)
+	list.add(key2, now.Add(500*time.Millisecond))
+
+	assert.True(t, list.consume(key1, now))
+	assert.False(t, list.consume(key1, now.Add(time.Second)))
+	assert.True(t, list.consume(key2, now.Add(time.Second)))
+	assert.False(t, list.consume(key2, now.Add(time.Second)))
+
+	list.add(key2, now.Add(time.Second))
+	assert.False(t, list.consume(key2, now.Add(3*time.Second)))
+	assert.Empty(t, list.keys)
+	assert.Empty(t, list.queue)
+}
@@ -1,7 +1,10 @@
 package broker
 
 import (
+	"bytes"
+	"crypto/x509"
 	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/256dpi/gomqtt/session"
 	"github.com/256dpi/gomqtt/transport"
 
+	"github.com/juju/ratelimit"
 	"gopkg.in/tomb.v2"
 )
 
@@ -120,6 +124,10 @@ type Backend interface {
 	// Retained messages that match the supplied subscription should be added to
 	// a temporary queue that is also drained when Dequeue is called. The messages
 	// must be delivered with the retained flag set to true.
+	//
+	// The backend may deny individual subscriptions by setting their QOS to
+	// packet.QOSFailure before calling the Ack. The returned Suback will then
+	// carry the failure return code for these subscriptions.
 	Subscribe(client *Client, subs []packet.Subscription, ack Ack) error
 
 	// Unsubscribe should unsubscribe the passed client from the specified topics
@@ -173,6 +181,10 @@ var ErrUnexpectedPacket = errors.New("unexpected packet")
 // ErrNotAuthorized is returned when a client is not authorized.
 var ErrNotAuthorized = errors.New("not authorized")
 
+// ErrUnsupportedVersion is returned when a client connects with a protocol
+// version that is not supported.
+var ErrUnsupportedVersion = errors.New("unsupported version")
+
 // ErrMissingSession is returned if the backend does not return a session.
 var ErrMissingSession = errors.New("missing session")
 
@@ -220,6 +232,46 @@ type Client struct {
 	// Will default to 30 seconds.
 	TokenTimeout time.Duration
 
+	// PublishRate may be set during Setup to limit the number of messages per
+	// second a client can publish. If the limit is exceeded, the client stops
+	// reading from the connection until enough time has passed. This applies
+	// backpressure to the publisher without dropping messages.
+	//
+	// Will default to unlimited.
+	PublishRate float64
+
+	// PublishBurst may be set during Setup to allow a client to publish a
+	// number of messages at once before PublishRate applies.
+	//
+	// Will default to 1.
+	PublishBurst int
+
+	// WillDelay may be set during Setup to delay the publication of the will
+	// message after the client went offline. The will is discarded if the
+	// backend calls DiscardWill in the meantime, e.g. because the client
+	// reconnected.
+	//
+	// Will default to no delay.
+	WillDelay time.Duration
+
+	// MaximumQOS may be set during Setup to limit the QOS level of the
+	// client's subscriptions and published messages. Subscriptions above the
+	// limit are granted with the maximum QOS level and published messages as
+	// well as the will message are forwarded with it. The acknowledgement flow
+	// with the client still follows the QOS level of the received packet.
+	//
+	// Will default to 2.
+	MaximumQOS packet.QOS
+
+	// IdleTimeout may be set during Setup to close the connection if no packet
+	// has been received within the duration. Other than the keep alive
+	// timeout of 1.5 times the requested keep alive, it also applies to
+	// clients that disabled keep alive. If both are set, the smaller timeout
+	// is used.
+	//
+	// Will default to no timeout.
+	IdleTimeout time.Duration
+
 	// PacketCallback can be set to inspect packets before processing and
 	// apply rate limits. To guarantee the connection lifecycle, Connect and
 	// Disconnect packets are not provided to the callback.
@@ -229,9 +281,14 @@ type Client struct {
 	backend Backend
 	conn    transport.Conn
 
-	id      string
-	will    *packet.Message
-	session Session
+	engine      *Engine
+	accepted    bool
+	id          string
+	will        *packet.Message
+	discardWill uint32
+	willTimer   *time.Timer
+	session     Session
+	mutex       sync.RWMutex
 
 	ackQueue chan packet.Generic
 
@@ -239,18 +296,26 @@ type Client struct {
 	subscribeTokens chan struct{}
 	dequeueTokens   chan struct{}
 
+	publishBucket *ratelimit.Bucket
+
 	tomb tomb.Tomb
 	done chan struct{}
 }
 
 // NewClient takes over a connection and returns a Client.
 func NewClient(backend Backend, conn transport.Conn) *Client {
+	return newClient(backend, conn, nil)
+}
+
+func newClient(backend Backend, conn transport.Conn, engine *Engine) *Client {
 	// create client
 	c := &Client{
-		state:   clientConnecting,
-		backend: backend,
-		conn:    conn,
-		done:    make(chan struct{}),
+		state:      clientConnecting,
+		backend:    backend,
+		conn:       conn,
+		engine:     engine,
+		MaximumQOS: 2,
+		done:       make(chan struct{}),
 	}
 
 	// start processor
@@ -271,6 +336,9 @@ func NewClient(backend Backend, conn transport.Conn) *Client {
 
 // Session returns the current Session used by the client.
 func (c *Client) Session() Session {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return c.session
 }
 
@@ -285,12 +353,58 @@ func (c *Client) Conn() transport.Conn {
 	return c.conn
 }
 
+// Certificate returns the verified certificate the client presented during the
+// TLS handshake. Nil is returned if the connection does not use TLS or the
+// certificate has not been verified, e.g. because the tls.Config of the server
+// does not set ClientAuth to tls.VerifyClientCertIfGiven or
+// tls.RequireAndVerifyClientCert.
+func (c *Client) Certificate() *x509.Certificate {
+	// get connection state
+	conn, ok := c.conn.(transport.TLSConn)
+	if !ok {
+		return nil
+	}
+	state, ok := conn.ConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
+
 // Close will immediately close the client.
 func (c *Client) Close() {
 	c.tomb.Kill(ErrClientClosed)
 	c.conn.Close()
 }
 
+// CloseWithoutWill will immediately close the client like Close but will also
+// prevent an eventual will message from being published. This is used when the
+// session is taken over by a new client with the same id.
+func (c *Client) CloseWithoutWill() {
+	atomic.StoreUint32(&c.discardWill, 1)
+	c.Close()
+}
+
+// DiscardWill will prevent an eventual will message from being published. It
+// returns whether a will has been discarded that was not yet published. This
+// is used to cancel a delayed will if the client reconnects in time.
+func (c *Client) DiscardWill() bool {
+	// mark will
+	if !atomic.CompareAndSwapUint32(&c.discardWill, 0, 1) {
+		return false
+	}
+
+	// stop delayed will
+	c.mutex.Lock()
+	if c.willTimer != nil {
+		c.willTimer.Stop()
+	}
+	c.mutex.Unlock()
+
+	return true
+}
+
 // Closing returns a channel that is closed when the client is closing.
 func (c *Client) Closing() <-chan struct{} {
 	return c.tomb.Dying()
@@ -307,9 +421,24 @@ func (c *Client) Closed() <-chan struct{} {
 func (c *Client) processor() error {
 	c.backend.Log(NewConnection, c, nil, nil, nil)
 
+	// keep the connection open if the connect packet has an unsupported
+	// protocol version to respond with a connack
+	keeper, _ := c.conn.(transport.KeepOpener)
+	if keeper != nil {
+		keeper.SetKeepOpen(func(err error) bool {
+			return errors.Is(err, packet.ErrInvalidProtocolVersion)
+		})
+	}
+
 	// get first packet from connection
 	pkt, err := c.conn.Receive()
-	if err != nil {
+	if keeper != nil {
+		keeper.SetKeepOpen(nil)
+	}
+	if errors.Is(err, packet.ErrInvalidProtocolVersion) {
+		c.connected(false)
+		return c.rejectVersion()
+	} else if err != nil {
 		return c.die(TransportError, err)
 	}
 
@@ -323,6 +452,7 @@ func (c *Client) processor() error {
 
 	// process connect
 	err = c.processConnect(connect)
+	c.connected(err == nil)
 	if err != nil {
 		return err // error has already been handled
 	}
@@ -471,6 +601,11 @@ func (c *Client) acker() error {
 
 // handle an incoming Connect packet
 func (c *Client) processConnect(pkt *packet.Connect) error {
+	// check version
+	if c.engine != nil && c.engine.SupportedVersions != nil && !bytes.Contains(c.engine.SupportedVersions, []byte{pkt.Version}) {
+		return c.rejectVersion()
+	}
+
 	// save id
 	c.id = pkt.ClientID
 
@@ -503,13 +638,6 @@ func (c *Client) processConnect(pkt *packet.Connect) error {
 	// set state
 	atomic.StoreUint32(&c.state, clientConnected)
 
-	// set keep alive
-	if pkt.KeepAlive > 0 {
-		c.conn.SetReadTimeout(time.Duration(pkt.KeepAlive) * 1500 * time.Millisecond)
-	} else {
-		c.conn.SetReadTimeout(0)
-	}
-
 	// retrieve session
 	s, resumed, err := c.backend.Setup(c, pkt.ClientID, pkt.CleanSession)
 	if err != nil {
@@ -522,7 +650,9 @@ func (c *Client) processConnect(pkt *packet.Connect) error {
 	connack.SessionPresent = !pkt.CleanSession && resumed
 
 	// assign session
+	c.mutex.Lock()
 	c.session = s
+	c.mutex.Unlock()
 
 	// set default parallel publishes
 	if c.ParallelPublishes <= 0 {
@@ -544,6 +674,26 @@ func (c *Client) processConnect(pkt *packet.Connect) error {
 		c.TokenTimeout = 30 * time.Second
 	}
 
+	// set default publish burst
+	if c.PublishBurst <= 0 {
+		c.PublishBurst = 1
+	}
+
+	// set read timeout using the keep alive and the idle timeout
+	timeout := c.IdleTimeout
+	if pkt.KeepAlive > 0 {
+		keepAlive := time.Duration(pkt.KeepAlive) * 1500 * time.Millisecond
+		if timeout <= 0 || keepAlive < timeout {
+			timeout = keepAlive
+		}
+	}
+	c.conn.SetReadTimeout(timeout)
+
+	// prepare publish bucket
+	if c.PublishRate > 0 {
+		c.publishBucket = ratelimit.NewBucketWithRate(c.PublishRate, int64(c.PublishBurst))
+	}
+
 	// prepare publish tokens
 	c.publishTokens = make(chan struct{}, c.ParallelPublishes)
 	for i := 0; i < c.ParallelPublishes; i++ {
@@ -567,7 +717,7 @@ func (c *Client) processConnect(pkt *packet.Connect) error {
 
 	// save will if present
 	if pkt.Will != nil {
-		c.will = pkt.Will
+		c.will = c.limitQOS(pkt.Will)
 	}
 
 	// send connack
@@ -673,18 +823,25 @@ func (c *Client) processSubscribe(pkt *packet.Subscribe) error {
 		return tomb.ErrDying
 	}
 
-	// prepare suback packet
-	suback := packet.NewSuback()
-	suback.ReturnCodes = make([]packet.QOS, len(pkt.Subscriptions))
-	suback.ID = pkt.ID
-
-	// set granted qos
+	// downgrade subscriptions above the maximum qos
 	for i, subscription := range pkt.Subscriptions {
-		suback.ReturnCodes[i] = subscription.QOS
+		if subscription.QOS > c.MaximumQOS {
+			pkt.Subscriptions[i].QOS = c.MaximumQOS
+		}
 	}
 
 	// subscribe client to queue
 	err := c.backend.Subscribe(c, pkt.Subscriptions, func() {
+		// prepare suback packet
+		suback := packet.NewSuback()
+		suback.ReturnCodes = make([]packet.QOS, len(pkt.Subscriptions))
+		suback.ID = pkt.ID
+
+		// set granted qos as eventually changed by the backend
+		for i, subscription := range pkt.Subscriptions {
+			suback.ReturnCodes[i] = subscription.QOS
+		}
+
 		select {
 		case c.ackQueue <- suback:
 		case <-c.tomb.Dying():
@@ -729,6 +886,18 @@ func (c *Client) processUnsubscribe(pkt *packet.Unsubscribe) error {
 
 // handle an incoming publish packet
 func (c *Client) processPublish(publish *packet.Publish) error {
+	// wait until the rate limit allows the publish
+	if c.publishBucket != nil {
+		if d := c.publishBucket.Take(1); d > 0 {
+			select {
+			case <-time.After(d):
+				// continue
+			case <-c.tomb.Dying():
+				return tomb.ErrDying
+			}
+		}
+	}
+
 	// handle qos 0 flow
 	if publish.Message.QOS == 0 {
 		// publish message
@@ -759,7 +928,7 @@ func (c *Client) processPublish(publish *packet.Publish) error {
 		puback.ID = publish.ID
 
 		// publish message and queue puback if ack is called
-		err := c.backend.Publish(c, &publish.Message, func() {
+		err := c.backend.Publish(c, c.limitQOS(&publish.Message), func() {
 			c.backend.Log(MessageAcknowledged, c, nil, &publish.Message, nil)
 
 			select {
@@ -860,7 +1029,7 @@ func (c *Client) processPubrel(id packet.ID) error {
 	}
 
 	// publish message and queue pubcomp if ack is called
-	err = c.backend.Publish(c, &publish.Message, func() {
+	err = c.backend.Publish(c, c.limitQOS(&publish.Message), func() {
 		c.backend.Log(MessageAcknowledged, c, nil, &publish.Message, nil)
 
 		select {
@@ -877,6 +1046,36 @@ func (c *Client) processPubrel(id packet.ID) error {
 	return nil
 }
 
+// returns a copy of the message with the maximum qos if it is above the limit
+func (c *Client) limitQOS(msg *packet.Message) *packet.Message {
+	// return message as is if allowed
+	if msg.QOS <= c.MaximumQOS {
+		return msg
+	}
+
+	// downgrade copy
+	msg = msg.Copy()
+	msg.QOS = c.MaximumQOS
+
+	return msg
+}
+
+// responds with a Connack and closes the client
+func (c *Client) rejectVersion() error {
+	// prepare connack packet
+	connack := packet.NewConnack()
+	connack.ReturnCode = packet.InvalidProtocolVersion
+
+	// send connack
+	err := c.send(connack, false)
+	if err != nil {
+		return c.die(TransportError, err)
+	}
+
+	// close client
+	return c.die(ClientError, ErrUnsupportedVersion)
+}
+
 // handle an incoming disconnect packet
 func (c *Client) processDisconnect() error {
 	// clear will
@@ -921,17 +1120,65 @@ func (c *Client) die(event LogEvent, err error) error {
 	return err
 }
 
+// reports the result of the connection attempt to the engine
+func (c *Client) connected(success bool) {
+	// remember success
+	c.accepted = success
+
+	// call callback
+	if c.engine != nil && c.engine.OnConnect != nil {
+		c.engine.OnConnect(c.id, success)
+	}
+}
+
+// reports the disconnection of an accepted client to the engine
+func (c *Client) disconnected() {
+	// check callback
+	if !c.accepted || c.engine == nil || c.engine.OnDisconnect == nil {
+		return
+	}
+
+	// get error and clear it for clean disconnects
+	err := c.tomb.Err()
+	if errors.Is(err, ErrClientDisconnected) {
+		err = nil
+	}
+
+	// call callback
+	c.engine.OnDisconnect(c.id, err)
+}
+
+// publishes the will message if it has not been discarded
+func (c *Client) publishWill(will *packet.Message) {
+	// check and mark will
+	if !c.DiscardWill() {
+		return
+	}
+
+	// publish message
+	err := c.backend.Publish(c, will, nil)
+	if err != nil {
+		c.backend.Log(BackendError, c, nil, nil, err)
+	}
+
+	c.backend.Log(MessagePublished, c, nil, will, nil)
+}
+
 // will try to cleanup as many resources as possible
 func (c *Client) cleanup() {
-	// check if not cleanly connected and will is present
-	if atomic.LoadUint32(&c.state) == clientConnected && c.will != nil {
-		// publish message
-		err := c.backend.Publish(c, c.will, nil)
-		if err != nil {
-			c.backend.Log(BackendError, c, nil, nil, err)
+	// check if not cleanly connected and will is present and not discarded
+	if atomic.LoadUint32(&c.state) == clientConnected && c.will != nil && atomic.LoadUint32(&c.discardWill) == 0 {
+		if c.WillDelay > 0 {
+			// publish will later unless discarded in the meantime
+			will := c.will
+			c.mutex.Lock()
+			c.willTimer = time.AfterFunc(c.WillDelay, func() {
+				c.publishWill(will)
+			})
+			c.mutex.Unlock()
+		} else {
+			c.publishWill(c.will)
 		}
-
-		c.backend.Log(MessagePublished, c, nil, c.will, nil)
 	}
 
 	// remove client from the queue
@@ -943,4 +1190,7 @@ func (c *Client) cleanup() {
 	}
 
 	c.backend.Log(LostConnection, c, nil, nil, nil)
+
+	// report disconnection
+	c.disconnected()
 }
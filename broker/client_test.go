@@ -148,3 +148,180 @@ func TestClientTokenTimeoutDequeue(t *testing.T) {
 
 	safeReceive(done)
 }
+
+func TestClientQOSDowngrade(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	options := client.NewConfig("tcp://localhost:" + port)
+
+	client1 := client.New()
+
+	cf, err := client1.Connect(options)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	f := flow.New().
+		Send(packet.NewConnect()).
+		Receive(packet.NewConnack()).
+		Send(&packet.Subscribe{Subscriptions: []packet.Subscription{
+			{Topic: "qd/1", QOS: 1},
+			{Topic: "qd/0", QOS: 0},
+		}, ID: 1}).
+		Receive(&packet.Suback{ID: 1, ReturnCodes: []packet.QOS{1, 0}}).
+		Run(func() {
+			pf, err := client1.Publish("qd/1", nil, 2, false)
+			assert.NoError(t, err)
+			assert.NoError(t, pf.Wait(10*time.Second))
+		}).
+		Receive(&packet.Publish{Message: packet.Message{Topic: "qd/1", QOS: 1}, ID: 1}).
+		Send(&packet.Puback{ID: 1}).
+		Run(func() {
+			pf, err := client1.Publish("qd/0", nil, 2, false)
+			assert.NoError(t, err)
+			assert.NoError(t, pf.Wait(10*time.Second))
+		}).
+		Receive(&packet.Publish{Message: packet.Message{Topic: "qd/0", QOS: 0}}).
+		Send(packet.NewDisconnect()).
+		End()
+
+	err = f.Test(conn)
+	assert.NoError(t, err)
+
+	err = client1.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestClientMaximumQOS(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.ClientMaximumQOS = 1
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	options := client.NewConfig("tcp://localhost:" + port)
+
+	client1 := client.New()
+
+	cf, err := client1.Connect(options)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	f := flow.New().
+		Send(packet.NewConnect()).
+		Receive(packet.NewConnack()).
+		Send(&packet.Subscribe{Subscriptions: []packet.Subscription{
+			{Topic: "mq/2", QOS: 2},
+			{Topic: "mq/0", QOS: 0},
+		}, ID: 1}).
+		Receive(&packet.Suback{ID: 1, ReturnCodes: []packet.QOS{1, 0}}).
+		Run(func() {
+			pf, err := client1.Publish("mq/2", nil, 2, false)
+			assert.NoError(t, err)
+			assert.NoError(t, pf.Wait(10*time.Second))
+		}).
+		Receive(&packet.Publish{Message: packet.Message{Topic: "mq/2", QOS: 1}, ID: 1}).
+		Send(&packet.Puback{ID: 1}).
+		Send(packet.NewDisconnect()).
+		End()
+
+	err = f.Test(conn)
+	assert.NoError(t, err)
+
+	err = client1.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.ClientIdleTimeout = 100 * time.Millisecond
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	connect := packet.NewConnect()
+	connect.KeepAlive = 0
+
+	var start time.Time
+
+	f := flow.New().
+		Send(connect).
+		Receive(packet.NewConnack()).
+		Run(func() {
+			time.Sleep(50 * time.Millisecond)
+		}).
+		Send(packet.NewPingreq()).
+		Receive(packet.NewPingresp()).
+		Run(func() {
+			time.Sleep(50 * time.Millisecond)
+		}).
+		Send(packet.NewPingreq()).
+		Receive(packet.NewPingresp()).
+		Run(func() {
+			start = time.Now()
+		}).
+		End()
+
+	err = f.Test(conn)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	close(quit)
+
+	safeReceive(done)
+}
+
+func TestClientUnsupportedVersion(t *testing.T) {
+	engine := NewEngine(NewMemoryBackend())
+	engine.SupportedVersions = []byte{packet.Version311}
+
+	port, quit, done := Run(engine, "tcp")
+
+	connack := packet.NewConnack()
+	connack.ReturnCode = packet.InvalidProtocolVersion
+
+	// unknown protocol level
+	connect := packet.NewConnect()
+	buf := make([]byte, connect.Len())
+	_, err := connect.Encode(buf)
+	assert.NoError(t, err)
+	buf[8] = 5
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	_, err = conn.(*transport.NetConn).UnderlyingConn().Write(buf)
+	assert.NoError(t, err)
+
+	err = flow.New().Receive(connack).End().Test(conn)
+	assert.NoError(t, err)
+
+	// disabled protocol level
+	connect.Version = packet.Version31
+
+	conn, err = transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	err = flow.New().Send(connect).Receive(connack).End().Test(conn)
+	assert.NoError(t, err)
+
+	close(quit)
+
+	safeReceive(done)
+}
@@ -2,10 +2,16 @@
 package broker
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/256dpi/gomqtt/session"
 	"github.com/256dpi/gomqtt/transport"
 
 	"gopkg.in/tomb.v2"
@@ -22,10 +28,44 @@ type Engine struct {
 	// The DefaultReadLimit defines the initial read limit.
 	DefaultReadLimit int64
 
+	// SupportedVersions can be set to limit the accepted protocol versions.
+	// Clients connecting with another version are rejected with a Connack
+	// that carries the packet.InvalidProtocolVersion return code. Versions
+	// that are not implemented by the packet package are always rejected.
+	//
+	// Will default to packet.Version31 and packet.Version311.
+	SupportedVersions []byte
+
+	// OnConnect can be used to observe connection attempts. It is called with
+	// the client id and whether the client has been accepted after the
+	// Connect packet has been processed. Rejected attempts, e.g. due to an
+	// unsupported version or failed authentication, report false.
+	OnConnect func(clientID string, success bool)
+
+	// OnDisconnect can be used to observe the disconnection of accepted
+	// clients. The error is nil if the client disconnected cleanly using a
+	// Disconnect packet. Otherwise it carries the reason, e.g. ErrClientClosed
+	// if the broker closed the client or a transport error if the connection
+	// has been lost. In these cases an eventual will message is published.
+	//
+	// Note: Both callbacks are called from the client goroutines and must be
+	// safe for concurrent use.
+	OnDisconnect func(clientID string, err error)
+
+	// TLSConfig is used by Listen to launch "tls", "mqtts" and "wss" servers.
+	TLSConfig *tls.Config
+
+	// WebSocketCompression enables the negotiation of the permessage-deflate
+	// extension on "ws" and "wss" servers launched by Listen.
+	WebSocketCompression bool
+
 	// OnError can be used to receive errors from engine. If an error is received
 	// the server should be restarted.
 	OnError func(error)
 
+	servers []transport.Server
+	clients map[*Client]struct{}
+
 	mutex sync.Mutex
 	tomb  tomb.Tomb
 }
@@ -35,11 +75,19 @@ func NewEngine(backend Backend) *Engine {
 	return &Engine{
 		Backend:        backend,
 		ConnectTimeout: 10 * time.Second,
+		clients:        make(map[*Client]struct{}),
 	}
 }
 
-// Accept begins accepting connections from the passed server.
+// Accept begins accepting connections from the passed server. The engine takes
+// ownership of the server and closes it when the engine is closed or shut
+// down.
 func (e *Engine) Accept(server transport.Server) {
+	// remember server
+	e.mutex.Lock()
+	e.servers = append(e.servers, server)
+	e.mutex.Unlock()
+
 	e.tomb.Go(func() error {
 		for {
 			// return if dying
@@ -66,6 +114,29 @@ func (e *Engine) Accept(server transport.Server) {
 	})
 }
 
+// Listen launches a server using the specified url and begins accepting
+// connections from it. It can be called multiple times to serve clients over
+// different transports and ports at the same time. The returned server can be
+// closed to stop listening on its address. Like servers passed to Accept, it
+// is closed with the engine.
+func (e *Engine) Listen(urlString string) (transport.Server, error) {
+	// prepare launcher
+	launcher := transport.NewLauncher()
+	launcher.TLSConfig = e.TLSConfig
+	launcher.WebSocketCompression = e.WebSocketCompression
+
+	// launch server
+	server, err := launcher.Launch(urlString)
+	if err != nil {
+		return nil, err
+	}
+
+	// start accepting connections
+	e.Accept(server)
+
+	return server, nil
+}
+
 // Handle takes over responsibility and handles a transport.Conn. It returns
 // false if the engine is closing and the connection has been closed.
 func (e *Engine) Handle(conn transport.Conn) bool {
@@ -91,15 +162,27 @@ func (e *Engine) Handle(conn transport.Conn) bool {
 	conn.SetReadTimeout(e.ConnectTimeout)
 
 	// handle client
-	NewClient(e.Backend, conn)
+	client := newClient(e.Backend, conn, e)
+
+	// track client
+	if e.clients == nil {
+		e.clients = make(map[*Client]struct{})
+	}
+	e.clients[client] = struct{}{}
+	go func() {
+		<-client.Closed()
+
+		e.mutex.Lock()
+		delete(e.clients, client)
+		e.mutex.Unlock()
+	}()
 
 	return true
 }
 
-// Close will stop handling incoming connections and close all acceptors. The
-// call will block until all acceptors returned.
-//
-// Note: All passed servers to Accept must be closed before calling this method.
+// Close will stop handling incoming connections and close all servers passed
+// to Accept or launched by Listen. Servers that have already been closed by
+// the caller are tolerated. The call will block until all acceptors returned.
 func (e *Engine) Close() {
 	// acquire mutex
 	e.mutex.Lock()
@@ -107,15 +190,120 @@ func (e *Engine) Close() {
 
 	// stop acceptors
 	e.tomb.Kill(nil)
-	e.tomb.Wait()
+
+	// close servers, errors are ignored
+	for _, server := range e.servers {
+		server.Close()
+	}
+
+	// wait for acceptors
+	if len(e.servers) > 0 {
+		e.tomb.Wait()
+	}
+}
+
+// Shutdown will gracefully shutdown the engine. It immediately stops handling
+// new connections and then waits until all connected clients have no more
+// inflight messages or the context is cancelled. Afterwards, all clients and
+// servers passed to Accept are closed. The context error is returned if the
+// clients have not been drained in time.
+//
+// Note: MQTT 3.1.1 does not allow the broker to send a Disconnect packet,
+// therefore the connections are closed and eventual will messages published.
+func (e *Engine) Shutdown(ctx context.Context) error {
+	// stop handling new connections
+	e.mutex.Lock()
+	e.tomb.Kill(nil)
+	e.mutex.Unlock()
+
+	// wait for clients to drain
+	err := e.drain(ctx)
+
+	// close clients
+	e.mutex.Lock()
+	for client := range e.clients {
+		client.Close()
+	}
+	servers := e.servers
+	e.mutex.Unlock()
+
+	// close servers, errors are ignored
+	for _, server := range servers {
+		server.Close()
+	}
+
+	// wait for acceptors
+	if len(servers) > 0 {
+		e.tomb.Wait()
+	}
+
+	return err
+}
+
+func (e *Engine) drain(ctx context.Context) error {
+	// prepare ticker
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		// check clients
+		if e.drained() {
+			return nil
+		}
+
+		// await next check
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (e *Engine) drained() bool {
+	// acquire mutex
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// check all clients
+	for client := range e.clients {
+		// get session
+		sess := client.Session()
+		if sess == nil {
+			continue
+		}
+
+		// check stored packets
+		for _, dir := range []session.Direction{session.Incoming, session.Outgoing} {
+			packets, err := sess.AllPackets(dir)
+			if err == nil && len(packets) > 0 {
+				return false
+			}
+		}
+	}
+
+	return true
 }
 
 // Run runs the passed engine on a random available port and returns a channel
 // that can be closed to shutdown the engine. This method is intended to be used
 // in testing scenarios.
+//
+// The listener is bound before Run returns and connections are queued by the
+// operating system until they are accepted. Clients may therefore connect
+// immediately without waiting for the engine.
+//
+// For the "unix" protocol a socket in the temporary directory is used and its
+// path is returned instead of the port.
 func Run(engine *Engine, protocol string) (string, chan struct{}, chan struct{}) {
+	// prepare url
+	urlString := protocol + "://localhost:0"
+	if protocol == "unix" {
+		urlString = "unix://" + filepath.Join(os.TempDir(), fmt.Sprintf("gomqtt-%d.sock", time.Now().UnixNano()))
+	}
+
 	// launch server
-	server, err := transport.Launch(protocol + "://localhost:0")
+	server, err := engine.Listen(urlString)
 	if err != nil {
 		panic(err)
 	}
@@ -124,9 +312,6 @@ func Run(engine *Engine, protocol string) (string, chan struct{}, chan struct{})
 	quit := make(chan struct{})
 	done := make(chan struct{})
 
-	// start accepting connections
-	engine.Accept(server)
-
 	// prepare shutdown
 	go func() {
 		// wait for signal
@@ -141,6 +326,11 @@ func Run(engine *Engine, protocol string) (string, chan struct{}, chan struct{})
 		close(done)
 	}()
 
+	// return path of unix sockets
+	if protocol == "unix" {
+		return server.Addr().String(), quit, done
+	}
+
 	// get random port
 	_, port, _ := net.SplitHostPort(server.Addr().String())
 
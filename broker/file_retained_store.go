@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrInvalidMessageFile is returned by OpenFileRetainedStore if a stored
+// message file could not be decoded.
+var ErrInvalidMessageFile = errors.New("invalid message file")
+
+const (
+	messageFileExt = ".msg"
+	tempFileExt    = ".tmp"
+)
+
+// A FileRetainedStore stores retained messages as individual files in a
+// directory. The files are named after a hash of the topic, which is stored in
+// the file as part of the message. All messages are additionally kept in a
+// MemoryRetainedStore so that searches do not hit the disk. Messages are
+// written to a temporary file that is synced and atomically renamed, which
+// ensures that a crash never leaves a partially written message behind.
+type FileRetainedStore struct {
+	dir    string
+	memory *MemoryRetainedStore
+	mutex  sync.Mutex
+}
+
+// OpenFileRetainedStore opens or creates a FileRetainedStore in the specified
+// directory. Previously stored messages are loaded from the directory.
+func OpenFileRetainedStore(dir string) (*FileRetainedStore, error) {
+	// prepare store
+	s := &FileRetainedStore{
+		dir:    dir,
+		memory: NewMemoryRetainedStore(),
+	}
+
+	// ensure directory
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// read directory
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+
+		// remove left over temporary files from interrupted writes
+		if strings.HasSuffix(entry.Name(), tempFileExt) {
+			err = os.Remove(name)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		// skip unknown files
+		if !strings.HasSuffix(entry.Name(), messageFileExt) {
+			continue
+		}
+
+		// read file
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// decode message
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMessageFile, name, err)
+		}
+
+		// add message
+		_ = s.memory.Store(msg)
+	}
+
+	return s, nil
+}
+
+// Store will store the message as the retained message of its topic. The call
+// returns after the message has been durably written.
+func (s *FileRetainedStore) Store(msg *packet.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// encode message
+	buf, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// write file
+	err = writeFile(s.dir, s.path(msg.Topic), messageFileExt, buf)
+	if err != nil {
+		return err
+	}
+
+	return s.memory.Store(msg)
+}
+
+// Clear will remove the retained message of the specified topic.
+func (s *FileRetainedStore) Clear(topic string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// remove file
+	err := os.Remove(s.path(topic) + messageFileExt)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.memory.Clear(topic)
+}
+
+// Search will return all retained messages matching the filter.
+func (s *FileRetainedStore) Search(filter string) ([]*packet.Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.memory.Search(filter)
+}
+
+func (s *FileRetainedStore) path(topic string) string {
+	return filepath.Join(s.dir, hashName(topic))
+}
+
+// hashName returns a fixed size file name for the specified key as keys may be
+// longer than the file names supported by the file system
+func hashName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFile writes the data to a temporary file that is synced and atomically
+// renamed to the path with the specified extension
+func writeFile(dir, path, ext string, buf []byte) error {
+	// get paths
+	tmp := path + tempFileExt
+	final := path + ext
+
+	// create temporary file
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// write and sync data
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	// close file
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+
+	// remove temporary file on error
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// move file into place
+	err = os.Rename(tmp, final)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// sync directory
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if cErr := d.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+func encodeMessage(msg *packet.Message) ([]byte, error) {
+	// prepare publish
+	publish := packet.NewPublish()
+	publish.Message = *msg
+	if msg.QOS > 0 {
+		publish.ID = 1
+	}
+
+	// encode publish
+	buf := make([]byte, publish.Len())
+	_, err := publish.Encode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func decodeMessage(buf []byte) (*packet.Message, error) {
+	// detect packet
+	l, t := packet.DetectPacket(buf)
+	if l == 0 || l != len(buf) || t != packet.PUBLISH {
+		return nil, errors.New("incomplete packet")
+	}
+
+	// decode publish
+	publish := packet.NewPublish()
+	_, err := publish.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &publish.Message, nil
+}
@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrInvalidSessionFile is returned by the FileSessionStore if a stored
+// session file could not be decoded.
+var ErrInvalidSessionFile = errors.New("invalid session file")
+
+const sessionFileExt = ".sess"
+
+// the stored format of a session, packets and messages are stored in their
+// encoded form
+type sessionFile struct {
+	ID            string
+	Subscriptions []packet.Subscription
+	Incoming      [][]byte
+	Outgoing      [][]byte
+	Messages      [][]byte
+}
+
+// A FileSessionStore stores session states as individual files in a
+// directory. The files are named after a hash of the client id, which is
+// stored in the file as part of the state. Like in the FileRetainedStore,
+// states are written to a temporary file that is synced and atomically
+// renamed.
+type FileSessionStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// OpenFileSessionStore opens or creates a FileSessionStore in the specified
+// directory.
+func OpenFileSessionStore(dir string) (*FileSessionStore, error) {
+	// ensure directory
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// read directory
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove left over temporary files from interrupted writes
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tempFileExt) {
+			err = os.Remove(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &FileSessionStore{
+		dir: dir,
+	}, nil
+}
+
+// Save will store the state of the session with the specified id. The call
+// returns after the state has been durably written.
+func (s *FileSessionStore) Save(id string, state *SessionState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// prepare file
+	file := sessionFile{
+		ID:            id,
+		Subscriptions: state.Subscriptions,
+	}
+
+	// encode packets
+	var err error
+	file.Incoming, err = encodePackets(state.Incoming)
+	if err != nil {
+		return err
+	}
+	file.Outgoing, err = encodePackets(state.Outgoing)
+	if err != nil {
+		return err
+	}
+
+	// encode messages
+	for _, msg := range state.Messages {
+		buf, err := encodeMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		file.Messages = append(file.Messages, buf)
+	}
+
+	// encode file
+	buf, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(s.dir, s.path(id), sessionFileExt, buf)
+}
+
+// Load will return the state of the session with the specified id.
+func (s *FileSessionStore) Load(id string) (*SessionState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// read file
+	_, state, err := s.read(s.path(id) + sessionFileExt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return state, err
+}
+
+// Remove will delete the state of the session with the specified id.
+func (s *FileSessionStore) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// remove file
+	err := os.Remove(s.path(id) + sessionFileExt)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// List will return the ids of all stored sessions.
+func (s *FileSessionStore) List() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// read directory
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// read ids
+	var ids []string
+	for _, entry := range entries {
+		// skip unknown files
+		if !strings.HasSuffix(entry.Name(), sessionFileExt) {
+			continue
+		}
+
+		// read file
+		id, _, err := s.read(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (s *FileSessionStore) read(name string) (string, *SessionState, error) {
+	// read file
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// decode file
+	var file sessionFile
+	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s: %v", ErrInvalidSessionFile, name, err)
+	}
+
+	// prepare state
+	state := &SessionState{
+		Subscriptions: file.Subscriptions,
+	}
+
+	// decode packets
+	state.Incoming, err = decodePackets(file.Incoming)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s: %v", ErrInvalidSessionFile, name, err)
+	}
+	state.Outgoing, err = decodePackets(file.Outgoing)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s: %v", ErrInvalidSessionFile, name, err)
+	}
+
+	// decode messages
+	for _, buf := range file.Messages {
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %s: %v", ErrInvalidSessionFile, name, err)
+		}
+
+		state.Messages = append(state.Messages, msg)
+	}
+
+	return file.ID, state, nil
+}
+
+func (s *FileSessionStore) path(id string) string {
+	return filepath.Join(s.dir, hashName(id))
+}
+
+func encodePackets(pkts []packet.Generic) ([][]byte, error) {
+	var list [][]byte
+	for _, pkt := range pkts {
+		buf := make([]byte, pkt.Len())
+		_, err := pkt.Encode(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, buf)
+	}
+
+	return list, nil
+}
+
+func decodePackets(list [][]byte) ([]packet.Generic, error) {
+	var pkts []packet.Generic
+	for _, buf := range list {
+		// detect packet
+		l, t := packet.DetectPacket(buf)
+		if l == 0 || l != len(buf) {
+			return nil, errors.New("incomplete packet")
+		}
+
+		// create packet
+		pkt, err := t.New()
+		if err != nil {
+			return nil, err
+		}
+
+		// decode packet
+		_, err = pkt.Decode(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		pkts = append(pkts, pkt)
+	}
+
+	return pkts, nil
+}
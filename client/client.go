@@ -3,9 +3,13 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"math"
 	"net/url"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +17,7 @@ import (
 	"github.com/256dpi/gomqtt/client/future"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/session"
+	"github.com/256dpi/gomqtt/topic"
 	"github.com/256dpi/gomqtt/transport"
 
 	"gopkg.in/tomb.v2"
@@ -30,6 +35,11 @@ var ErrClientNotConnected = errors.New("client not connected")
 // the config while requesting to resume a session.
 var ErrClientMissingID = errors.New("client missing id")
 
+// ErrClientInvalidID is returned by Connect if the ClientID in the config does
+// not conform to the MQTT 3.1.1 specification and Config.AllowLongClientID is
+// not set.
+var ErrClientInvalidID = errors.New("client invalid id")
+
 // ErrClientConnectionDenied is returned in the Callback if the connection has
 // been reject by the broker.
 var ErrClientConnectionDenied = errors.New("client connection denied")
@@ -38,26 +48,81 @@ var ErrClientConnectionDenied = errors.New("client connection denied")
 // in time to a Pingreq.
 var ErrClientMissingPong = errors.New("client missing pong")
 
+// ErrClientUnsupportedVersion is returned by Connect if the requested protocol
+// version is not supported.
+var ErrClientUnsupportedVersion = errors.New("client unsupported version")
+
+// ErrClientInvalidKeepAlive is returned by Connect if the keep alive interval
+// exceeds the maximum of 65535 seconds.
+var ErrClientInvalidKeepAlive = errors.New("client invalid keep alive")
+
+// ErrClientPendingMessages is returned by Disconnect if the futures of queued
+// packets did not complete within the specified timeout. The connection is
+// closed anyway.
+var ErrClientPendingMessages = errors.New("client pending messages")
+
 // ErrClientExpectedConnack is returned when the first received packet is not a
 // Connack.
 var ErrClientExpectedConnack = errors.New("client expected connack")
 
+// ErrClientUnknownMessage is returned by Ack if the message is not awaiting a
+// manual acknowledgement.
+var ErrClientUnknownMessage = errors.New("client unknown message")
+
+// ErrClientStoreFull is returned by Publish if storing the message would exceed
+// Config.MaxStoreBytes and Config.BlockOnFullStore is not set.
+var ErrClientStoreFull = errors.New("client store full")
+
+// ErrClientNotSubscribed is returned by Unsubscribe and UnsubscribeMultiple
+// if Config.ValidateUnsubs is set and a topic filter is not subscribed.
+var ErrClientNotSubscribed = errors.New("client not subscribed")
+
+// ErrClientMaxRetransmit is returned by the future of a message that has not
+// been acknowledged after Config.MaxRetransmits retransmissions.
+var ErrClientMaxRetransmit = errors.New("client max retransmit")
+
+// ErrClientInvalidCodec is returned by Connect if the configured PayloadCodec
+// is invalid, e.g. a GzipCodec with an unknown compression level.
+var ErrClientInvalidCodec = errors.New("client invalid codec")
+
 // ErrFailedSubscription is returned when a submitted subscription is marked as
 // failed when Config.ValidateSubs must be set to true.
 var ErrFailedSubscription = errors.New("failed subscription")
 
+// ErrInvalidTopic is returned by Publish and Subscribe if a topic or topic
+// filter is not valid.
+var ErrInvalidTopic = errors.New("invalid topic")
+
 // A Callback is a function called by the client upon received messages or
 // internal errors. An error can be returned if the callback is not already
 // called with an error to instantly close the client and prevent it from
 // sending any acknowledgments for the specified message.
 //
+// Messages are dispatched from a single goroutine in the order the packets
+// have been received from the connection.
+//
+// The message carries the QOS and retain flag of the received Publish packet.
+// The QOS is the one selected by the broker and may be lower than the one
+// requested with the subscription.
+//
 // Note: Execution of the client is before the callback is called and resumed
 // after the callback returns. This means that waiting on a future inside the
 // callback will deadlock the client.
 type Callback func(msg *packet.Message, err error) error
 
-// A Logger is a function called by the client to log activity.
-type Logger func(msg string)
+// a handler wraps a MessageCallback to allow storing it in a topic tree
+type handler struct {
+	callback MessageCallback
+}
+
+// An Interceptor is a function called by the client for every incoming packet
+// before it is processed and every outgoing packet before it is sent. The
+// returned packet is used instead of the passed packet and may be the passed
+// packet itself. If nil is returned the packet is dropped.
+//
+// Note: Outgoing packets are intercepted after they have been stored in the
+// session.
+type Interceptor func(pkt packet.Generic, incoming bool) packet.Generic
 
 const (
 	clientInitialized uint32 = iota
@@ -68,9 +133,56 @@ const (
 	clientDisconnected
 )
 
-// A Session is used to persist incoming and outgoing packets.
+// A State describes the connection state of a client or service.
+type State int
+
+const (
+	// StateInitialized is the state of a client that has not yet been
+	// connected.
+	StateInitialized State = iota
+
+	// StateConnecting is the state while waiting for a Connack or while a
+	// service is reconnecting.
+	StateConnecting
+
+	// StateConnected is the state once the connection has been accepted.
+	StateConnected
+
+	// StateDisconnecting is the state while the connection is closed.
+	StateDisconnecting
+
+	// StateDisconnected is the state once the connection has been closed or a
+	// service has been stopped.
+	StateDisconnected
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateInitialized:
+		return "Initialized"
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateDisconnecting:
+		return "Disconnecting"
+	case StateDisconnected:
+		return "Disconnected"
+	}
+
+	return "Unknown"
+}
+
+// A Session is used to persist incoming and outgoing packets. Incoming and
+// outgoing packets are stored separately and identified by their packet id.
+// The methods are called from multiple goroutines and must be safe for
+// concurrent use. Custom implementations can be tested using spec.SessionTest.
+// Sessions may return new packet values on every call, retransmission attempts
+// are therefore tracked by packet id and type.
 type Session interface {
-	// NextID will return the next id for outgoing packets.
+	// NextID will return the next id for outgoing packets. The id must not be
+	// zero.
 	NextID() packet.ID
 
 	// SavePacket will store a packet in the session. An eventual existing
@@ -78,6 +190,7 @@ type Session interface {
 	SavePacket(session.Direction, packet.Generic) error
 
 	// LookupPacket will retrieve a packet from the session using a packet id.
+	// It must return a nil packet and no error if the packet does not exist.
 	LookupPacket(session.Direction, packet.ID) (packet.Generic, error)
 
 	// DeletePacket will remove a packet from the session. The method must not
@@ -91,6 +204,17 @@ type Session interface {
 	Reset() error
 }
 
+// A SizedSession is a Session that reports the encoded size of its stored
+// packets. The session must implement this interface to be limited by
+// Config.MaxStoreBytes.
+type SizedSession interface {
+	Session
+
+	// Size will return the encoded size in bytes of all packets currently
+	// saved in the session.
+	Size(session.Direction) int
+}
+
 // A Client connects to a broker and handles the transmission of packets. It will
 // automatically send PingreqPackets to keep the connection alive. Outgoing
 // publish related packets will be stored in session and resent when the
@@ -98,6 +222,10 @@ type Session interface {
 // when the packets get acknowledged by the broker. Once the connection is closed
 // all waiting futures get canceled.
 //
+// The methods of a connected client may be called from multiple goroutines.
+// Packet ids are assigned and packets are written while holding the client
+// mutex.
+//
 // Note: If clean session is set to false and there are packets in the session,
 // messages might get completed after connecting without triggering any futures
 // to complete.
@@ -111,7 +239,8 @@ type Client struct {
 	Session Session
 
 	// The callback to be called by the client upon receiving a message or
-	// encountering an error while processing incoming packets.
+	// encountering an error while processing incoming packets. Use SetCallback
+	// to change the callback after the client has been connected.
 	Callback Callback
 
 	// The logger that is used to log low level information about packets
@@ -119,12 +248,50 @@ type Client struct {
 	// automatic keep alive handler.
 	Logger Logger
 
+	// The levelled logger that is used instead of Logger if set. Packets and
+	// keep alive details are logged with the debug level.
+	LevelLogger LevelLogger
+
+	// The interceptor that is called with all sent and received packets to
+	// observe or modify them.
+	OnPacket Interceptor
+
+	// The channel that receives lifecycle events. Events are sent without
+	// blocking and get dropped if the channel is not ready to receive.
+	Events chan<- Event
+
 	clean bool
 
 	keepAlive     time.Duration
 	tracker       *Tracker
 	futureStore   *future.Store
 	connectFuture *future.Future
+	counters      *counters
+	handlers      *topic.Tree
+	subscriptions *topic.Tree
+
+	pings     []*future.Future
+	pingMutex sync.Mutex
+	inflight  chan struct{}
+	freed     chan struct{}
+	buffer    chan *packet.Message
+
+	pending      map[*packet.Message]packet.ID
+	pendingMutex sync.Mutex
+
+	paused     uint32
+	held       []*packet.Publish
+	pauseMutex sync.Mutex
+
+	drainMutex sync.Mutex
+	ackMutex   sync.Mutex
+
+	sentTimes map[packet.ID]time.Time
+	sentMutex sync.Mutex
+
+	callbackMutex  sync.RWMutex
+	messages       chan *packet.Message
+	messagesClosed bool
 
 	tomb   tomb.Tomb
 	mutex  sync.Mutex
@@ -134,9 +301,13 @@ type Client struct {
 // New returns a new client that by default uses a fresh MemorySession.
 func New() *Client {
 	return &Client{
-		state:       clientInitialized,
-		Session:     session.NewMemorySession(),
-		futureStore: future.NewStore(),
+		state:         clientInitialized,
+		Session:       session.NewMemorySession(),
+		futureStore:   future.NewStore(),
+		handlers:      topic.NewTree(),
+		subscriptions: topic.NewTree(),
+		counters:      &counters{},
+		pending:       make(map[*packet.Message]packet.ID),
 	}
 }
 
@@ -144,6 +315,16 @@ func New() *Client {
 // return a ConnectFuture that gets completed once a Connack has been
 // received. If the Connect packet couldn't be transmitted it will return an error.
 func (c *Client) Connect(config *Config) (ConnectFuture, error) {
+	return c.ConnectContext(context.Background(), config)
+}
+
+// ConnectContext is like Connect but will abort dialing the broker and sending
+// the Connect packet if the context is cancelled. In that case the contexts
+// error is returned.
+//
+// Note: The context is only used to establish the connection. Use the returned
+// ConnectFuture to wait for the Connack.
+func (c *Client) ConnectContext(ctx context.Context, config *Config) (ConnectFuture, error) {
 	if config == nil {
 		panic("no config specified")
 	}
@@ -165,32 +346,74 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 		return nil, err
 	}
 
-	// check client id
-	if !config.CleanSession && config.ClientID == "" {
-		return nil, ErrClientMissingID
-	}
-
-	// parse keep alive
-	keepAlive, err := time.ParseDuration(config.KeepAlive)
+	// validate config
+	err = config.Validate()
 	if err != nil {
 		return nil, err
 	}
 
+	// get version
+	version := config.Version
+	if version == 0 {
+		version = packet.Version311
+	}
+
+	// get keep alive, a negative value disables keep alive
+	keepAlive := config.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	} else if keepAlive < 0 {
+		keepAlive = 0
+	}
+
 	// allocate and initialize tracker
 	c.keepAlive = keepAlive
 	c.tracker = NewTracker(keepAlive)
 
+	// prepare inflight slots
+	if config.MaxInflight > 0 {
+		c.inflight = make(chan struct{}, config.MaxInflight)
+	}
+
+	// prepare store signal
+	if config.MaxStoreBytes > 0 {
+		c.freed = make(chan struct{}, 1)
+	}
+
+	// prepare callback buffer
+	if config.CallbackBuffer > 0 {
+		c.buffer = make(chan *packet.Message, config.CallbackBuffer)
+	}
+
 	// dial broker (with custom dialer if present)
-	if config.Dialer != nil {
+	if contextDialer, ok := config.Dialer.(ContextDialer); ok {
+		c.conn, err = contextDialer.DialContext(ctx, config.BrokerURL)
+	} else if config.Dialer != nil {
 		c.conn, err = config.Dialer.Dial(config.BrokerURL)
-		if err != nil {
-			return nil, err
-		}
+	} else if config.TLSConfig != nil || config.WebSocketHeaders != nil || config.WebSocketCompression {
+		dialer := transport.NewDialer()
+		dialer.TLSConfig = config.TLSConfig
+		dialer.RequestHeader = config.WebSocketHeaders
+		dialer.WebSocketCompression = config.WebSocketCompression
+		c.conn, err = dialer.DialContext(ctx, config.BrokerURL)
 	} else {
-		c.conn, err = transport.Dial(config.BrokerURL)
-		if err != nil {
-			return nil, err
+		c.conn, err = transport.DialContext(ctx, config.BrokerURL)
+	}
+
+	// check context as custom dialers might not respect it
+	if ctx.Err() != nil {
+		if c.conn != nil {
+			c.conn.Close()
 		}
+
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, err
+	}
+
+	// set read limit
+	if config.MaxPacketSize > 0 {
+		c.conn.SetReadLimit(config.MaxPacketSize)
 	}
 
 	// set to connecting as from this point the client cannot be reused
@@ -213,8 +436,9 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 	// allocate packet
 	connect := packet.NewConnect()
 	connect.ClientID = config.ClientID
-	connect.KeepAlive = uint16(keepAlive.Seconds())
+	connect.KeepAlive = uint16(math.Ceil(keepAlive.Seconds()))
 	connect.CleanSession = config.CleanSession
+	connect.Version = version
 
 	// check for credentials
 	if urlParts.User != nil {
@@ -222,27 +446,123 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 		connect.Password, _ = urlParts.User.Password()
 	}
 
+	// set explicit credentials
+	if config.Username != "" {
+		connect.Username = config.Username
+		connect.Password = config.Password
+	}
+
 	// set will
 	connect.Will = config.WillMessage
 
+	// encode will payload
+	if connect.Will != nil && len(connect.Will.Payload) > 0 && config.PayloadCodec != nil {
+		connect.Will = connect.Will.Copy()
+		connect.Will.Payload = config.PayloadCodec.Encode(connect.Will.Payload)
+	}
+
 	// create new ConnectFuture
 	c.connectFuture = future.New()
 
+	// close connection if the context is cancelled while sending
+	sent := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-sent:
+		}
+	}()
+
 	// send connect packet
 	err = c.send(connect, false)
-	if err != nil {
+	close(sent)
+	if ctx.Err() != nil {
+		return nil, c.cleanup(ctx.Err(), true, true)
+	} else if err != nil {
 		return nil, c.cleanup(err, false, false)
 	}
 
 	// start process routine
 	c.tomb.Go(c.processor)
 
+	// close messages channel once all goroutines have exited
+	go func() {
+		<-c.tomb.Dead()
+		c.closeMessages()
+	}()
+
+	// start deliverer if buffered
+	if c.buffer != nil {
+		c.tomb.Go(c.deliverer)
+	}
+
 	// wrap future
 	wrappedFuture := &connectFuture{c.connectFuture}
 
 	return wrappedFuture, nil
 }
 
+// ConnectAny works like Connect but tries the specified broker urls in order
+// until a connection has been established. The BrokerURL of the config is
+// ignored and the error of the last attempt is returned if all attempts fail.
+// The used url can be obtained using BrokerURL.
+func (c *Client) ConnectAny(urls []string, config *Config) (ConnectFuture, error) {
+	if len(urls) == 0 {
+		panic("no urls specified")
+	}
+
+	var err error
+	for _, u := range urls {
+		// copy config
+		cfg := *config
+		cfg.BrokerURL = u
+
+		// attempt to connect
+		var connectFuture ConnectFuture
+		connectFuture, err = c.Connect(&cfg)
+		if err == nil {
+			return connectFuture, nil
+		}
+
+		// return if the client cannot be reused
+		if atomic.LoadUint32(&c.state) >= clientConnecting {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// BrokerURL returns the url of the broker the client is connected to.
+func (c *Client) BrokerURL() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// check config
+	if c.config == nil {
+		return ""
+	}
+
+	return c.config.BrokerURL
+}
+
+// State returns the current connection state of the client.
+func (c *Client) State() State {
+	switch atomic.LoadUint32(&c.state) {
+	case clientInitialized:
+		return StateInitialized
+	case clientConnecting, clientConnacked:
+		return StateConnecting
+	case clientConnected:
+		return StateConnected
+	case clientDisconnecting:
+		return StateDisconnecting
+	default:
+		return StateDisconnected
+	}
+}
+
 // Publish will send a Publish packet containing the passed parameters. It will
 // return a PublishFuture that gets completed once the quality of service flow
 // has been completed.
@@ -257,22 +577,140 @@ func (c *Client) Publish(topic string, payload []byte, qos packet.QOS, retain bo
 	return c.PublishMessage(msg)
 }
 
+// PublishJSON will send a Publish packet containing the JSON encoding of the
+// passed value. Encoding errors are returned before anything is sent.
+func (c *Client) PublishJSON(topic string, v interface{}, qos packet.QOS, retain bool) (GenericFuture, error) {
+	// encode value
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Publish(topic, payload, qos, retain)
+}
+
+// PublishRetained will send a Publish packet with the retain flag set. The
+// broker will keep the message as the retained message of the topic.
+func (c *Client) PublishRetained(topic string, payload []byte, qos packet.QOS) (GenericFuture, error) {
+	return c.Publish(topic, payload, qos, true)
+}
+
+// ClearRetained will send a retained Publish packet with an empty payload to
+// remove the retained message of the topic from the broker. The message is
+// sent with QOS 1 to ensure the broker received it.
+func (c *Client) ClearRetained(topic string) (GenericFuture, error) {
+	return c.Publish(topic, nil, 1, true)
+}
+
+// PublishMultiple will send a Publish packet containing the passed payload to
+// each of the passed topics. It will return a future per topic in the same
+// order. If publishing fails, the futures of the already sent messages are
+// returned together with the error.
+func (c *Client) PublishMultiple(topics []string, payload []byte, qos packet.QOS, retain bool) ([]GenericFuture, error) {
+	// prepare list
+	futures := make([]GenericFuture, 0, len(topics))
+
+	for _, topic := range topics {
+		// publish message
+		publishFuture, err := c.Publish(topic, payload, qos, retain)
+		if err != nil {
+			return futures, err
+		}
+
+		// add future
+		futures = append(futures, publishFuture)
+	}
+
+	return futures, nil
+}
+
 // PublishMessage will send a Publish containing the passed message. It will
 // return a PublishFuture that gets completed once the quality of service flow
 // has been completed.
+//
+// Messages with a QOS of zero are written to the connection before the call
+// returns and an eventual write error is returned. However, the completion of
+// the future still does not guarantee that the broker received the message.
+//
+// If Config.MaxInflight is set, the call will block until an inflight slot is
+// available for messages with a QOS greater than zero.
+//
+// If Config.MaxStoreBytes is set, ErrClientStoreFull is returned or the call
+// blocks if Config.BlockOnFullStore is set until enough outgoing packets have
+// been acknowledged to store messages with a QOS greater than zero.
 func (c *Client) PublishMessage(msg *packet.Message) (GenericFuture, error) {
+	publishFuture, _, err := c.publishMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return publishFuture, nil
+}
+
+// PublishContext will publish a message like Publish and wait until the quality
+// of service flow has been completed. If the context is cancelled before, the
+// message is removed from the session, its packet id is released and the
+// contexts error is returned. The message will not be resent in that case.
+//
+// Note: The broker may still have received and forwarded the message.
+func (c *Client) PublishContext(ctx context.Context, topic string, payload []byte, qos packet.QOS, retain bool) error {
+	// publish message
+	publishFuture, id, err := c.publishMessage(&packet.Message{
+		Topic:   topic,
+		Payload: payload,
+		QOS:     qos,
+		Retain:  retain,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.awaitContext(ctx, id, publishFuture)
+}
+
+func (c *Client) publishMessage(msg *packet.Message) (*future.Future, packet.ID, error) {
+	// check topic
+	if !packet.ValidTopicName(msg.Topic) {
+		return nil, 0, ErrInvalidTopic
+	}
+
+	// acquire inflight slot if limited
+	if msg.QOS > 0 && c.inflight != nil {
+		select {
+		case c.inflight <- struct{}{}:
+		case <-c.tomb.Dying():
+			return nil, 0, ErrClientNotConnected
+		}
+	}
+
+	// reserve store space if limited
+	if msg.QOS > 0 && c.freed != nil {
+		err := c.reserveStore(msg)
+		if err != nil {
+			c.releaseInflight()
+			return nil, 0, err
+		}
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	// check if connected
 	if atomic.LoadUint32(&c.state) != clientConnected {
-		return nil, ErrClientNotConnected
+		c.releaseInflight()
+		return nil, 0, ErrClientNotConnected
 	}
 
 	// allocate publish packet
 	publish := packet.NewPublish()
 	publish.Message = *msg
 
+	// encode payload, empty payloads are sent unchanged to clear retained
+	// messages
+	if c.config.PayloadCodec != nil && len(msg.Payload) > 0 {
+		publish.Message.Payload = c.config.PayloadCodec.Encode(msg.Payload)
+	}
+
 	// set packet id
 	if msg.QOS > 0 {
 		publish.ID = c.Session.NextID()
@@ -286,16 +724,18 @@ func (c *Client) PublishMessage(msg *packet.Message) (GenericFuture, error) {
 
 	// store packet if at least qos 1
 	if msg.QOS > 0 {
+		c.drainMutex.Lock()
 		err := c.Session.SavePacket(session.Outgoing, publish)
+		c.drainMutex.Unlock()
 		if err != nil {
-			return nil, c.cleanup(err, true, false)
+			return nil, 0, c.cleanup(err, true, false)
 		}
 	}
 
-	// send packet
-	err := c.send(publish, true)
+	// send packet, qos 0 packets are written immediately to surface errors
+	err := c.send(publish, msg.QOS > 0)
 	if err != nil {
-		return nil, c.cleanup(err, false, false)
+		return nil, 0, c.cleanup(err, false, false)
 	}
 
 	// complete and remove qos 0 future
@@ -304,7 +744,113 @@ func (c *Client) PublishMessage(msg *packet.Message) (GenericFuture, error) {
 		c.futureStore.Delete(publish.ID)
 	}
 
-	return publishFuture, nil
+	return publishFuture, publish.ID, nil
+}
+
+// Ack will acknowledge a message that has been received with a QOS greater
+// than zero while Config.ManualAck is set. The message must be the one passed
+// to the callback. A Puback is sent for QOS 1 and a Pubrec for QOS 2 messages.
+// Messages with QOS 0 do not need to be acknowledged.
+func (c *Client) Ack(msg *packet.Message) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		return ErrClientNotConnected
+	}
+
+	// ignore qos 0 messages
+	if msg.QOS == 0 {
+		return nil
+	}
+
+	// get pending message
+	c.pendingMutex.Lock()
+	id, ok := c.pending[msg]
+	delete(c.pending, msg)
+	c.pendingMutex.Unlock()
+
+	// check message
+	if !ok {
+		return ErrClientUnknownMessage
+	}
+
+	// acknowledge qos 1 message
+	if msg.QOS == 1 {
+		puback := packet.NewPuback()
+		puback.ID = id
+
+		err := c.send(puback, true)
+		if err != nil {
+			return c.cleanup(err, false, false)
+		}
+
+		return nil
+	}
+
+	// prepare pubrec packet
+	pubrec := packet.NewPubrec()
+	pubrec.ID = id
+
+	// overwrite stored Publish with the Pubrec to not dispatch it again
+	err := c.Session.SavePacket(session.Incoming, pubrec)
+	if err != nil {
+		return c.cleanup(err, true, false)
+	}
+
+	// acknowledge qos 2 message
+	err = c.send(pubrec, true)
+	if err != nil {
+		return c.cleanup(err, false, false)
+	}
+
+	return nil
+}
+
+// Pause will stop passing received messages to the callback, handlers and the
+// messages channel. QOS 1 and 2 messages are held and not acknowledged until
+// Resume is called, which lets the broker apply backpressure once its inflight
+// window is exhausted. QOS 0 messages are dropped and passed to Config.OnDrop.
+// Other packets, including the keep alive, are still processed. Pause may be
+// called from the callback.
+func (c *Client) Pause() {
+	atomic.StoreUint32(&c.paused, 1)
+}
+
+// Resume will dispatch and acknowledge all messages that have been held since
+// Pause has been called and continue passing received messages. Held messages
+// are dispatched from the calling goroutine. An error is returned if the
+// callback failed for a held message, which also closes the client. Held
+// messages are discarded if the client is not connected anymore, the broker
+// will redeliver them with a persistent session.
+//
+// Note: Resume must not be called from the callback.
+func (c *Client) Resume() error {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+
+	// resume
+	atomic.StoreUint32(&c.paused, 0)
+
+	// get held messages
+	held := c.held
+	c.held = nil
+
+	// check if connected
+	if len(held) > 0 && atomic.LoadUint32(&c.state) != clientConnected {
+		return ErrClientNotConnected
+	}
+
+	// handle held messages
+	for _, publish := range held {
+		err := c.handlePublish(publish)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Subscribe will send a Subscribe packet containing one topic to subscribe. It
@@ -316,16 +862,88 @@ func (c *Client) Subscribe(topic string, qos packet.QOS) (SubscribeFuture, error
 	})
 }
 
+// SubscribeWithHandler will send a Subscribe packet like Subscribe and register
+// the specified handler for the topic. Received messages that match the topic
+// are passed to the handler instead of the Callback. If a message matches
+// multiple handlers all of them are called. The handler is removed once the
+// topic is unsubscribed.
+//
+// Note: The handler is executed like the Callback and the same constraints
+// apply.
+func (c *Client) SubscribeWithHandler(topic string, qos packet.QOS, callback MessageCallback) (SubscribeFuture, error) {
+	// register handler
+	h := &handler{callback: callback}
+	c.handlers.Set(topic, h)
+
+	// subscribe topic
+	subscribeFuture, err := c.Subscribe(topic, qos)
+	if err != nil {
+		c.handlers.Remove(topic, h)
+		return nil, err
+	}
+
+	return subscribeFuture, nil
+}
+
 // SubscribeMultiple will send a Subscribe packet containing multiple topics to
 // subscribe. It will return a SubscribeFuture that gets completed once a
 // Suback packet has been received.
 func (c *Client) SubscribeMultiple(subscriptions []packet.Subscription) (SubscribeFuture, error) {
+	subFuture, _, err := c.subscribeMultiple(subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// wrap future
+	wrappedFuture := &subscribeFuture{subFuture}
+
+	return wrappedFuture, nil
+}
+
+// SubscribeContext will subscribe a topic like Subscribe and wait until the
+// Suback has been received. It returns the granted QOS level. If the context is
+// cancelled before, the pending future is removed, its packet id is released
+// and the contexts error is returned.
+//
+// Note: The broker may still have received and granted the subscription.
+func (c *Client) SubscribeContext(ctx context.Context, topic string, qos packet.QOS) (packet.QOS, error) {
+	// subscribe topic
+	subFuture, id, err := c.subscribeMultiple([]packet.Subscription{
+		{Topic: topic, QOS: qos},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// wait for suback
+	err = c.awaitContext(ctx, id, subFuture)
+	if err != nil {
+		return 0, err
+	}
+
+	// get return code
+	codes := (&subscribeFuture{subFuture}).ReturnCodes()
+	if len(codes) == 0 {
+		return packet.QOSFailure, nil
+	}
+
+	return codes[0], nil
+}
+
+func (c *Client) subscribeMultiple(subscriptions []packet.Subscription) (*future.Future, packet.ID, error) {
+	// check topic filters
+	for _, sub := range subscriptions {
+		if !packet.ValidTopicFilter(sub.Topic) {
+			return nil, 0, ErrInvalidTopic
+		}
+	}
+
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	// check if connected
 	if atomic.LoadUint32(&c.state) != clientConnected {
-		return nil, ErrClientNotConnected
+		return nil, 0, ErrClientNotConnected
 	}
 
 	// allocate subscribe packet
@@ -335,6 +953,7 @@ func (c *Client) SubscribeMultiple(subscriptions []packet.Subscription) (Subscri
 
 	// create future
 	subFuture := future.New()
+	subFuture.Data.Store(subscriptionsKey, subscriptions)
 
 	// store future
 	c.futureStore.Put(subscribe.ID, subFuture)
@@ -342,32 +961,157 @@ func (c *Client) SubscribeMultiple(subscriptions []packet.Subscription) (Subscri
 	// send packet
 	err := c.send(subscribe, true)
 	if err != nil {
-		return nil, c.cleanup(err, false, false)
+		return nil, 0, c.cleanup(err, false, false)
 	}
 
-	// wrap future
-	wrappedFuture := &subscribeFuture{subFuture}
-
-	return wrappedFuture, nil
+	return subFuture, subscribe.ID, nil
 }
 
-// Unsubscribe will send a Unsubscribe packet containing one topic to unsubscribe.
-// It will return a UnsubscribeFuture that gets completed once an Unsuback packet
-// has been received.
-func (c *Client) Unsubscribe(topic string) (GenericFuture, error) {
-	return c.UnsubscribeMultiple([]string{topic})
+// SetCallback will safely replace the callback while the client is connected.
+func (c *Client) SetCallback(callback Callback) {
+	c.callbackMutex.Lock()
+	c.Callback = callback
+	c.callbackMutex.Unlock()
 }
 
-// UnsubscribeMultiple will send a Unsubscribe packet containing multiple
-// topics to unsubscribe. It will return a UnsubscribeFuture that gets completed
-// once an Unsuback packet has been received.
-func (c *Client) UnsubscribeMultiple(topics []string) (GenericFuture, error) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// Messages returns a channel that receives all messages that are not handled
+// by a handler registered with SubscribeWithHandler. The channel is created on
+// the first call and buffered using Config.CallbackBuffer if the client has
+// already been connected. Once created, messages are no longer passed to the
+// Callback, which will only receive errors. The channel is closed after the
+// connection has been closed and all goroutines have exited.
+//
+// Note: Messages are acknowledged once they have been received from the
+// channel or put into its buffer. A slow reader blocks the client like a slow
+// callback.
+func (c *Client) Messages() <-chan *packet.Message {
+	c.callbackMutex.Lock()
+	defer c.callbackMutex.Unlock()
+
+	// return existing channel
+	if c.messages != nil {
+		return c.messages
+	}
 
-	// check if connected
-	if atomic.LoadUint32(&c.state) != clientConnected {
-		return nil, ErrClientNotConnected
+	// get buffer size
+	var size int
+	if c.config != nil {
+		size = c.config.CallbackBuffer
+	}
+
+	// create channel
+	c.messages = make(chan *packet.Message, size)
+
+	// close immediately if already closed
+	if c.messagesClosed {
+		close(c.messages)
+	}
+
+	return c.messages
+}
+
+// Subscriptions returns all subscriptions that have been granted by the broker
+// and not yet unsubscribed, sorted by topic.
+func (c *Client) Subscriptions() []packet.Subscription {
+	// get all subscriptions
+	items := c.subscriptions.All()
+
+	// prepare subscriptions
+	subs := make([]packet.Subscription, 0, len(items))
+	for _, v := range items {
+		subs = append(subs, v.(packet.Subscription))
+	}
+
+	// sort subscriptions
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Topic < subs[j].Topic
+	})
+
+	return subs
+}
+
+// Resubscribe will send a single Subscribe packet containing all subscriptions
+// of the previous client. As a client cannot be reused, it allows to restore
+// the subscriptions after manually reconnecting with a new client. The
+// returned future is completed immediately if there are no subscriptions.
+func (c *Client) Resubscribe(previous *Client) (SubscribeFuture, error) {
+	// get subscriptions
+	subs := previous.Subscriptions()
+
+	// complete immediately if empty
+	if len(subs) == 0 {
+		// check if connected
+		if atomic.LoadUint32(&c.state) != clientConnected {
+			return nil, ErrClientNotConnected
+		}
+
+		// create completed future
+		subFuture := future.New()
+		subFuture.Complete()
+
+		return &subscribeFuture{subFuture}, nil
+	}
+
+	return c.SubscribeMultiple(subs)
+}
+
+// Unsubscribe will send a Unsubscribe packet containing one topic to unsubscribe.
+// It will return a UnsubscribeFuture that gets completed once an Unsuback packet
+// has been received.
+func (c *Client) Unsubscribe(topic string) (GenericFuture, error) {
+	return c.UnsubscribeMultiple([]string{topic})
+}
+
+// UnsubscribeMultiple will send a Unsubscribe packet containing multiple
+// topics to unsubscribe. It will return a UnsubscribeFuture that gets completed
+// once an Unsuback packet has been received.
+func (c *Client) UnsubscribeMultiple(topics []string) (GenericFuture, error) {
+	unsubscribeFuture, _, err := c.unsubscribeMultiple(topics)
+	if err != nil {
+		return nil, err
+	}
+
+	return unsubscribeFuture, nil
+}
+
+// UnsubscribeContext will unsubscribe a topic like Unsubscribe and wait until
+// the Unsuback has been received. If the context is cancelled before, the
+// pending future is removed, its packet id is released and the contexts error
+// is returned.
+//
+// Note: The broker may still have received and removed the subscription.
+func (c *Client) UnsubscribeContext(ctx context.Context, topic string) error {
+	// unsubscribe topic
+	unsubscribeFuture, id, err := c.unsubscribeMultiple([]string{topic})
+	if err != nil {
+		return err
+	}
+
+	return c.awaitContext(ctx, id, unsubscribeFuture)
+}
+
+func (c *Client) unsubscribeMultiple(topics []string) (*future.Future, packet.ID, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		return nil, 0, ErrClientNotConnected
+	}
+
+	// validate topic filters if requested
+	if c.config.ValidateUnsubs {
+		for _, t := range topics {
+			if len(c.subscriptions.Get(t)) == 0 {
+				return nil, 0, ErrClientNotSubscribed
+			}
+		}
+	}
+
+	// remove handlers and subscriptions
+	for _, t := range topics {
+		c.handlers.Empty(t)
+		c.subscriptions.Empty(t)
 	}
 
 	// allocate unsubscribe packet
@@ -384,17 +1128,173 @@ func (c *Client) UnsubscribeMultiple(topics []string) (GenericFuture, error) {
 	// send packet
 	err := c.send(unsubscribe, true)
 	if err != nil {
-		return nil, c.cleanup(err, false, false)
+		return nil, 0, c.cleanup(err, false, false)
 	}
 
-	return unsubscribeFuture, nil
+	return unsubscribeFuture, unsubscribe.ID, nil
+}
+
+// PendingCount returns the number of outgoing QOS 1 and 2 messages that are
+// stored in the session and have not yet been acknowledged by the broker.
+func (c *Client) PendingCount() int {
+	c.drainMutex.Lock()
+	defer c.drainMutex.Unlock()
+
+	return c.pendingCount()
+}
+
+func (c *Client) pendingCount() int {
+	// check session
+	if c.Session == nil {
+		return 0
+	}
+
+	// get packets
+	packets, err := c.Session.AllPackets(session.Outgoing)
+	if err != nil {
+		return 0
+	}
+
+	return len(packets)
+}
+
+// Stats returns a snapshot of the clients counters.
+func (c *Client) Stats() Stats {
+	return c.counters.snapshot(c.Session)
+}
+
+// Ping will send a Pingreq and wait the specified amount of time for the
+// Pingresp. It returns the measured round trip time. Pings are independent of
+// the automatic keep alive and may be issued concurrently.
+func (c *Client) Ping(timeout time.Duration) (time.Duration, error) {
+	c.mutex.Lock()
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		c.mutex.Unlock()
+		return 0, ErrClientNotConnected
+	}
+
+	// create future
+	pingFuture := future.New()
+
+	// send pingreq
+	start := time.Now()
+	err := c.ping(pingFuture)
+	if err != nil {
+		err = c.cleanup(err, false, false)
+		c.mutex.Unlock()
+		return 0, err
+	}
+
+	c.mutex.Unlock()
+
+	// wait for pingresp
+	err = pingFuture.Wait(timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
+// Flush will block until all packets that have been sent are written to the
+// underlying connection or the context is cancelled. The call returns
+// immediately if the connection does not buffer packets.
+func (c *Client) Flush(ctx context.Context) error {
+	c.mutex.Lock()
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		c.mutex.Unlock()
+		return ErrClientNotConnected
+	}
+
+	// get flusher
+	flusher, ok := c.conn.(transport.Flusher)
+	c.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// flush connection
+	result := make(chan error, 1)
+	go func() {
+		result <- flusher.Flush()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublishRoundTrip will subscribe the topic, publish the payload and wait
+// until the message has been received back from the broker. This confirms
+// the full path through the broker and may be used for smoke tests. The
+// topic is unsubscribed before the call returns. The context can be used to
+// limit the time waiting.
+//
+// Note: The topic should not be subscribed otherwise as messages are passed
+// to a handler and the subscription is removed afterwards. The payload should
+// be unique to distinguish the message from other messages on the topic.
+func (c *Client) PublishRoundTrip(ctx context.Context, topic string, payload []byte, qos packet.QOS) error {
+	// prepare signal
+	received := make(chan struct{})
+	var once sync.Once
+
+	// subscribe topic
+	subscribeFuture, err := c.SubscribeWithHandler(topic, qos, func(msg *packet.Message) error {
+		if bytes.Equal(msg.Payload, payload) {
+			once.Do(func() {
+				close(received)
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// ensure unsubscribe
+	defer c.Unsubscribe(topic)
+
+	// wait for suback
+	err = waitContext(ctx, subscribeFuture)
+	if err != nil {
+		return err
+	}
+
+	// publish message
+	publishFuture, err := c.Publish(topic, payload, qos, false)
+	if err != nil {
+		return err
+	}
+
+	// wait for acknowledgement
+	err = waitContext(ctx, publishFuture)
+	if err != nil {
+		return err
+	}
+
+	// wait for message
+	select {
+	case <-received:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Disconnect will send a Disconnect packet and close the connection.
 //
 // If a timeout is specified, the client will wait the specified amount of time
 // for all queued futures to complete or cancel. If no timeout is specified it
-// will not wait at all.
+// will not wait at all. If the timeout is reached, the connection is closed
+// anyway and ErrClientPendingMessages is returned.
 func (c *Client) Disconnect(timeout ...time.Duration) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -405,8 +1305,9 @@ func (c *Client) Disconnect(timeout ...time.Duration) error {
 	}
 
 	// finish current packets
+	pending := false
 	if len(timeout) > 0 {
-		c.futureStore.Await(timeout[0])
+		pending = c.futureStore.Await(timeout[0]) == future.ErrTimeout
 	}
 
 	// set state
@@ -415,7 +1316,46 @@ func (c *Client) Disconnect(timeout ...time.Duration) error {
 	// send disconnect packet
 	err := c.send(packet.NewDisconnect(), false)
 
-	return c.end(err, true)
+	// end connection
+	err = c.end(err, true)
+	if err == nil && pending {
+		err = ErrClientPendingMessages
+	}
+
+	return err
+}
+
+// DisconnectWithWill will close the connection without sending a Disconnect
+// packet. The broker will therefore treat the disconnect as abnormal and
+// publish the will message. This allows clients to signal an unhealthy state
+// during a controlled exit.
+//
+// The timeout is handled the same way as in Disconnect.
+func (c *Client) DisconnectWithWill(timeout ...time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		return ErrClientNotConnected
+	}
+
+	// finish current packets
+	pending := false
+	if len(timeout) > 0 {
+		pending = c.futureStore.Await(timeout[0]) == future.ErrTimeout
+	}
+
+	// set state
+	atomic.StoreUint32(&c.state, clientDisconnecting)
+
+	// end connection
+	err := c.end(nil, false)
+	if err == nil && pending {
+		err = ErrClientPendingMessages
+	}
+
+	return err
 }
 
 // Close closes the client immediately without sending a Disconnect packet and
@@ -443,6 +1383,11 @@ func (c *Client) processor() error {
 		c.tomb.Go(c.pinger)
 	}
 
+	// start retransmissions if enabled
+	if c.config.RetransmitInterval > 0 {
+		c.tomb.Go(c.retransmitter)
+	}
+
 	for {
 		// get next packet from connection
 		pkt, err := c.conn.Receive()
@@ -456,11 +1401,23 @@ func (c *Client) processor() error {
 			return c.die(err, false, false)
 		}
 
-		// log received message
-		if c.Logger != nil {
-			c.Logger(fmt.Sprintf("Received: %s", pkt.String()))
+		// intercept packet
+		if c.OnPacket != nil {
+			pkt = c.OnPacket(pkt, true)
+			if pkt == nil {
+				continue
+			}
 		}
 
+		// log received message
+		c.log().Debug("Received", "packet", pkt)
+
+		// update counters
+		c.counters.received(pkt)
+
+		// emit event
+		emit(c.Events, Event{Kind: PacketReceived, Packet: pkt})
+
 		if first {
 			// get connack
 			connack, ok := pkt.(*packet.Connack)
@@ -483,13 +1440,13 @@ func (c *Client) processor() error {
 		case *packet.Unsuback:
 			err = c.processUnsuback(typedPkt)
 		case *packet.Pingresp:
-			c.tracker.Pong()
+			c.pong()
 		case *packet.Publish:
 			err = c.processPublish(typedPkt)
 		case *packet.Puback:
-			err = c.processPubackAndPubcomp(typedPkt.ID)
+			err = c.processPuback(typedPkt.ID)
 		case *packet.Pubcomp:
-			err = c.processPubackAndPubcomp(typedPkt.ID)
+			err = c.processPubcomp(typedPkt.ID)
 		case *packet.Pubrec:
 			err = c.processPubrec(typedPkt.ID)
 		case *packet.Pubrel:
@@ -527,6 +1484,14 @@ func (c *Client) processConnack(connack *packet.Connack) error {
 	// set state to connected
 	atomic.StoreUint32(&c.state, clientConnected)
 
+	// emit event
+	emit(c.Events, Event{Kind: Connected})
+
+	// report session resumption
+	if c.config.OnSessionResume != nil {
+		c.config.OnSessionResume(connack.SessionPresent)
+	}
+
 	// complete future
 	c.connectFuture.Complete()
 
@@ -582,6 +1547,18 @@ func (c *Client) processSuback(suback *packet.Suback) error {
 		}
 	}
 
+	// save granted subscriptions
+	if v, ok := subscribeFuture.Data.Load(subscriptionsKey); ok {
+		for i, sub := range v.([]packet.Subscription) {
+			if i < len(suback.ReturnCodes) && suback.ReturnCodes[i] != packet.QOSFailure {
+				c.subscriptions.Set(sub.Topic, packet.Subscription{
+					Topic: sub.Topic,
+					QOS:   suback.ReturnCodes[i],
+				})
+			}
+		}
+	}
+
 	// complete future
 	subscribeFuture.Data.Store(returnCodesKey, suback.ReturnCodes)
 	subscribeFuture.Complete()
@@ -614,13 +1591,60 @@ func (c *Client) processUnsuback(unsuback *packet.Unsuback) error {
 
 // handle an incoming Publish packet
 func (c *Client) processPublish(publish *packet.Publish) error {
+	c.pauseMutex.Lock()
+	defer c.pauseMutex.Unlock()
+
+	// hold or drop message if paused
+	if atomic.LoadUint32(&c.paused) == 1 {
+		if publish.Message.QOS == 0 {
+			if c.config.OnDrop != nil {
+				c.config.OnDrop(&publish.Message)
+			}
+		} else {
+			c.held = append(c.held, publish)
+		}
+
+		return nil
+	}
+
+	return c.handlePublish(publish)
+}
+
+// dispatch and acknowledge a Publish packet
+func (c *Client) handlePublish(publish *packet.Publish) error {
+	// decode payload
+	if c.config.PayloadCodec != nil && len(publish.Message.Payload) > 0 {
+		payload, err := c.config.PayloadCodec.Decode(publish.Message.Payload)
+		if err != nil {
+			return c.skipPublish(publish)
+		}
+
+		publish.Message.Payload = payload
+	}
+
+	// handle manually acknowledged messages
+	if c.config.ManualAck && publish.Message.QOS > 0 {
+		return c.processManualPublish(publish)
+	}
+
+	// buffer qos 0 messages if enabled
+	if publish.Message.QOS == 0 && c.buffer != nil {
+		select {
+		case c.buffer <- &publish.Message:
+		default:
+			if c.config.OnDrop != nil {
+				c.config.OnDrop(&publish.Message)
+			}
+		}
+
+		return nil
+	}
+
 	// call callback for unacknowledged and directly acknowledged messages
 	if publish.Message.QOS <= 1 {
-		if c.Callback != nil {
-			err := c.Callback(&publish.Message, nil)
-			if err != nil {
-				return c.die(err, true, true)
-			}
+		err := c.dispatch(&publish.Message)
+		if err != nil {
+			return c.die(err, true, true)
 		}
 	}
 
@@ -659,14 +1683,101 @@ func (c *Client) processPublish(publish *packet.Publish) error {
 	return nil
 }
 
+// acknowledge an incoming Publish packet without dispatching the message and
+// pass it to OnDrop
+func (c *Client) skipPublish(publish *packet.Publish) error {
+	// call drop callback
+	if c.config.OnDrop != nil {
+		c.config.OnDrop(&publish.Message)
+	}
+
+	// acknowledge qos 1 publish
+	if publish.Message.QOS == 1 {
+		puback := packet.NewPuback()
+		puback.ID = publish.ID
+
+		err := c.send(puback, true)
+		if err != nil {
+			return c.die(err, false, false)
+		}
+	}
+
+	// acknowledge qos 2 publish and store the pubrec to release the packet
+	// later without dispatching it
+	if publish.Message.QOS == 2 {
+		pubrec := packet.NewPubrec()
+		pubrec.ID = publish.ID
+
+		err := c.Session.SavePacket(session.Incoming, pubrec)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+
+		err = c.send(pubrec, true)
+		if err != nil {
+			return c.die(err, false, false)
+		}
+	}
+
+	return nil
+}
+
+// handle an incoming Puback packet
+func (c *Client) processPuback(id packet.ID) error {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+
+	// get packet from store
+	pkt, err := c.Session.LookupPacket(session.Outgoing, id)
+	if err != nil {
+		return c.die(err, true, false)
+	}
+
+	// check packet
+	publish, ok := pkt.(*packet.Publish)
+	if !ok || publish.Message.QOS != 1 {
+		return nil // ignore a wrongly sent Puback packet
+	}
+
+	return c.processPubackAndPubcomp(id)
+}
+
+// handle an incoming Pubcomp packet
+func (c *Client) processPubcomp(id packet.ID) error {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+
+	// get packet from store
+	pkt, err := c.Session.LookupPacket(session.Outgoing, id)
+	if err != nil {
+		return c.die(err, true, false)
+	}
+
+	// check packet as the qos 2 flow is only completed after the Pubrel
+	if _, ok := pkt.(*packet.Pubrel); !ok {
+		return nil // ignore a wrongly sent Pubcomp packet
+	}
+
+	return c.processPubackAndPubcomp(id)
+}
+
 // handle an incoming Puback or Pubcomp packet
 func (c *Client) processPubackAndPubcomp(id packet.ID) error {
 	// remove packet from store
-	err := c.Session.DeletePacket(session.Outgoing, id)
+	drained, err := c.removeOutgoing(id)
 	if err != nil {
 		return err
 	}
 
+	// call drain callback once the future has been completed
+	if drained {
+		defer c.drained()
+	}
+
+	// free inflight slot and store space
+	c.releaseInflight()
+	c.releaseStore()
+
 	// get future
 	publishFuture := c.futureStore.Get(id)
 	if publishFuture == nil {
@@ -682,16 +1793,169 @@ func (c *Client) processPubackAndPubcomp(id packet.ID) error {
 	return nil
 }
 
+// removes an outgoing packet from the session and returns whether no more
+// packets are pending
+func (c *Client) removeOutgoing(id packet.ID) (bool, error) {
+	c.drainMutex.Lock()
+	defer c.drainMutex.Unlock()
+
+	// remove packet
+	err := c.Session.DeletePacket(session.Outgoing, id)
+	if err != nil {
+		return false, err
+	}
+
+	// forget send time
+	c.sentMutex.Lock()
+	delete(c.sentTimes, id)
+	c.sentMutex.Unlock()
+
+	return c.pendingCount() == 0, nil
+}
+
+// calls OnDrain if available
+func (c *Client) drained() {
+	if c.config != nil && c.config.OnDrain != nil {
+		c.config.OnDrain()
+	}
+}
+
+// frees an inflight slot without blocking as resent packets from the session
+// did not acquire a slot
+func (c *Client) releaseInflight() {
+	if c.inflight == nil {
+		return
+	}
+
+	select {
+	case <-c.inflight:
+	default:
+	}
+}
+
+// waits until the message fits into the session or returns ErrClientStoreFull
+// if blocking is disabled
+func (c *Client) reserveStore(msg *packet.Message) error {
+	// get session
+	sess, ok := c.Session.(SizedSession)
+	if !ok {
+		return nil
+	}
+
+	// get size
+	size := (&packet.Publish{ID: 1, Message: *msg}).Len()
+
+	for {
+		// check size
+		if sess.Size(session.Outgoing)+size <= c.config.MaxStoreBytes {
+			// pass on signal to other waiting publishers
+			c.releaseStore()
+
+			return nil
+		}
+
+		// return error if not blocking
+		if !c.config.BlockOnFullStore {
+			return ErrClientStoreFull
+		}
+
+		// wait for space
+		select {
+		case <-c.freed:
+		case <-c.tomb.Dying():
+			return ErrClientNotConnected
+		}
+	}
+}
+
+// signals waiting publishers that outgoing packets have been removed from the
+// session
+func (c *Client) releaseStore() {
+	if c.freed == nil {
+		return
+	}
+
+	select {
+	case c.freed <- struct{}{}:
+	default:
+	}
+}
+
+// handle an incoming Publish packet that is acknowledged using Ack
+func (c *Client) processManualPublish(publish *packet.Publish) error {
+	// handle qos 2 flow
+	if publish.Message.QOS == 2 {
+		// get packet from store
+		pkt, err := c.Session.LookupPacket(session.Incoming, publish.ID)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+
+		// resend pubrec if the message has already been acknowledged
+		if pubrec, ok := pkt.(*packet.Pubrec); ok {
+			err = c.send(pubrec, true)
+			if err != nil {
+				return c.die(err, false, false)
+			}
+
+			return nil
+		}
+
+		// store packet
+		err = c.Session.SavePacket(session.Incoming, publish)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+	}
+
+	// save pending message
+	c.pendingMutex.Lock()
+	c.pending[&publish.Message] = publish.ID
+	c.pendingMutex.Unlock()
+
+	// call callback
+	err := c.dispatch(&publish.Message)
+	if err != nil {
+		return c.die(err, true, true)
+	}
+
+	return nil
+}
+
 // handle an incoming Pubrec packet
 func (c *Client) processPubrec(id packet.ID) error {
+	// get packet from store
+	pkt, err := c.Session.LookupPacket(session.Outgoing, id)
+	if err != nil {
+		return c.die(err, true, false)
+	}
+
 	// prepare pubrel packet
 	pubrel := packet.NewPubrel()
 	pubrel.ID = id
 
-	// overwrite stored Publish with the Pubrel packet
-	err := c.Session.SavePacket(session.Outgoing, pubrel)
-	if err != nil {
-		return c.die(err, true, false)
+	// overwrite stored Publish with the Pubrel packet. a duplicate Pubrec will
+	// find the Pubrel and a Pubrec for an unknown packet is answered without
+	// storing the Pubrel to not leave a dangling entry
+	switch stored := pkt.(type) {
+	case *packet.Publish:
+		if stored.Message.QOS != 2 {
+			return nil // ignore a wrongly sent Pubrec packet
+		}
+
+		err = c.Session.SavePacket(session.Outgoing, pubrel)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+
+		// the pubrel is smaller than the publish
+		c.releaseStore()
+	case *packet.Pubrel:
+		// already stored
+	case nil:
+		// unknown packet
+	default:
+		return nil // ignore a wrongly sent Pubrec packet
 	}
 
 	// send packet
@@ -711,15 +1975,10 @@ func (c *Client) processPubrel(id packet.ID) error {
 		return c.die(err, true, false)
 	}
 
-	// get packet from store
-	publish, ok := pkt.(*packet.Publish)
-	if !ok {
-		return nil // ignore a wrongly sent Pubrel packet
-	}
-
-	// call callback
-	if c.Callback != nil {
-		err = c.Callback(&publish.Message, nil)
+	// call callback if the packet has not yet been released. a duplicate
+	// Pubrel is acknowledged again without dispatching the message twice
+	if publish, ok := pkt.(*packet.Publish); ok {
+		err = c.dispatch(&publish.Message)
 		if err != nil {
 			return c.die(err, true, true)
 		}
@@ -727,7 +1986,7 @@ func (c *Client) processPubrel(id packet.ID) error {
 
 	// prepare pubcomp packet
 	pubcomp := packet.NewPubcomp()
-	pubcomp.ID = publish.ID
+	pubcomp.ID = id
 
 	// acknowledge Publish packet
 	err = c.send(pubcomp, true)
@@ -744,6 +2003,23 @@ func (c *Client) processPubrel(id packet.ID) error {
 	return nil
 }
 
+/* deliverer goroutine */
+
+// passes buffered messages to the matching handlers or the callback
+func (c *Client) deliverer() error {
+	for {
+		select {
+		case msg := <-c.buffer:
+			err := c.dispatch(msg)
+			if err != nil {
+				return c.die(err, true, true)
+			}
+		case <-c.tomb.Dying():
+			return tomb.ErrDying
+		}
+	}
+}
+
 /* pinger goroutine */
 
 // manages the sending of ping packets to keep the connection alive
@@ -760,18 +2036,13 @@ func (c *Client) pinger() error {
 			}
 
 			// send pingreq packet
-			err := c.send(packet.NewPingreq(), true)
+			err := c.ping(nil)
 			if err != nil {
 				return c.die(err, false, false)
 			}
-
-			// save ping attempt
-			c.tracker.Ping()
 		} else {
 			// log keep alive delay
-			if c.Logger != nil {
-				c.Logger(fmt.Sprintf("Delay KeepAlive by %s", window.String()))
-			}
+			c.log().Debug("Delay KeepAlive", "window", window)
 		}
 
 		select {
@@ -783,13 +2054,314 @@ func (c *Client) pinger() error {
 	}
 }
 
+// resends unacknowledged packets with an exponential backoff
+func (c *Client) retransmitter() error {
+	// prepare state, attempts are tracked by packet id and type as sessions
+	// may return new packet values on every call
+	type key struct {
+		id  packet.ID
+		typ packet.Type
+	}
+	attempts := make(map[key]int)
+
+	// check packets more often than the interval to resend them close to the
+	// time they are due
+	tick := c.config.RetransmitInterval / 4
+
+	for {
+		select {
+		case <-c.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(tick):
+		}
+
+		// get stored packets
+		packets, err := c.Session.AllPackets(session.Outgoing)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+
+		// check packets
+		now := time.Now()
+		seen := make(map[key]bool, len(packets))
+		for _, pkt := range packets {
+			// get id
+			id, ok := packet.GetID(pkt)
+			if !ok {
+				continue
+			}
+
+			// get send time, skip packets that have not yet been sent
+			sent, ok := c.sentTime(id)
+			if !ok {
+				continue
+			}
+
+			// get attempts
+			k := key{id: id, typ: pkt.Type()}
+			count := attempts[k]
+			seen[k] = true
+
+			// check if retransmission is due
+			if now.Sub(sent) < c.config.RetransmitInterval<<uint(count) {
+				continue
+			}
+
+			// give up on the packet if the attempts are exhausted
+			if c.config.MaxRetransmits > 0 && count >= c.config.MaxRetransmits {
+				c.abandon(id, pkt.Type(), ErrClientMaxRetransmit)
+				delete(attempts, k)
+				continue
+			}
+
+			// resend a copy of publish packets with the dup flag
+			switch typedPkt := pkt.(type) {
+			case *packet.Publish:
+				dup := *typedPkt
+				dup.Dup = true
+				err = c.send(&dup, true)
+			case *packet.Pubrel:
+				err = c.send(typedPkt, true)
+			default:
+				continue
+			}
+			if err != nil {
+				return c.die(err, false, false)
+			}
+
+			// update attempts
+			attempts[k] = count + 1
+		}
+
+		// forget acknowledged packets
+		for k := range attempts {
+			if !seen[k] {
+				delete(attempts, k)
+			}
+		}
+	}
+}
+
+// removes an outgoing packet that has not been acknowledged and fails its
+// future with the specified error. It does not acquire the client mutex as it
+// is called from the retransmitter, which is awaited with the mutex held.
+func (c *Client) abandon(id packet.ID, typ packet.Type, err error) {
+	// call drain callback after releasing the mutex
+	var drained bool
+	defer func() {
+		if drained {
+			c.drained()
+		}
+	}()
+
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+
+	// check if the packet is still pending
+	pkt, _ := c.Session.LookupPacket(session.Outgoing, id)
+	if pkt == nil || pkt.Type() != typ {
+		return
+	}
+
+	// remove future before the packet id is released
+	f := c.futureStore.Get(id)
+	c.futureStore.Delete(id)
+
+	// remove stored packet to release the packet id
+	drained, _ = c.removeOutgoing(id)
+
+	// free inflight slot and store space
+	c.releaseInflight()
+	c.releaseStore()
+
+	// fail future
+	if f != nil {
+		f.Fail(err)
+	}
+
+	c.log().Warn("Abandoned Packet", "packet", pkt, "error", err)
+}
+
+// remembers the time a publish or pubrel packet has been sent
+func (c *Client) markSent(pkt packet.Generic) {
+	// get id of retransmittable packets
+	var id packet.ID
+	switch typedPkt := pkt.(type) {
+	case *packet.Publish:
+		if typedPkt.Message.QOS == 0 {
+			return
+		}
+		id = typedPkt.ID
+	case *packet.Pubrel:
+		id = typedPkt.ID
+	default:
+		return
+	}
+
+	c.sentMutex.Lock()
+	defer c.sentMutex.Unlock()
+
+	// set time
+	if c.sentTimes == nil {
+		c.sentTimes = make(map[packet.ID]time.Time)
+	}
+	c.sentTimes[id] = time.Now()
+}
+
+// returns the time a publish or pubrel packet has been sent
+func (c *Client) sentTime(id packet.ID) (time.Time, bool) {
+	c.sentMutex.Lock()
+	defer c.sentMutex.Unlock()
+
+	t, ok := c.sentTimes[id]
+
+	return t, ok
+}
+
 /* helpers */
 
+// waits for the future to complete or the context to be cancelled
+func waitContext(ctx context.Context, f GenericFuture) error {
+	// wait for future
+	result := make(chan error, 1)
+	go func() {
+		result <- f.Wait(math.MaxInt64)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waits for the future like waitContext and abandons the pending operation if
+// the context is cancelled
+func (c *Client) awaitContext(ctx context.Context, id packet.ID, f *future.Future) error {
+	// wait for future
+	err := waitContext(ctx, f)
+	if err == nil || err != ctx.Err() {
+		return err
+	}
+
+	// call drain callback after releasing the mutex
+	var drained bool
+	defer func() {
+		if drained {
+			c.drained()
+		}
+	}()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+
+	// check if the future is still pending
+	if c.futureStore.Get(id) != f {
+		return err
+	}
+
+	// remove future
+	c.futureStore.Delete(id)
+	f.Cancel()
+
+	// remove stored packet to release the packet id
+	pkt, _ := c.Session.LookupPacket(session.Outgoing, id)
+	if pkt != nil {
+		drained, _ = c.removeOutgoing(id)
+
+		// free inflight slot and store space of publishes
+		switch pkt.(type) {
+		case *packet.Publish, *packet.Pubrel:
+			c.releaseInflight()
+			c.releaseStore()
+		}
+	}
+
+	return err
+}
+
+// passes a message to the matching handlers or the callback
+func (c *Client) dispatch(msg *packet.Message) error {
+	// call matching handlers
+	values := c.handlers.Match(msg.Topic)
+	if len(values) > 0 {
+		for _, value := range values {
+			err := value.(*handler).callback(msg)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// get callback and channel
+	c.callbackMutex.RLock()
+	callback := c.Callback
+	messages := c.messages
+	c.callbackMutex.RUnlock()
+
+	// otherwise send message to channel if present
+	if messages != nil {
+		select {
+		case messages <- msg:
+			return nil
+		case <-c.tomb.Dying():
+			return tomb.ErrDying
+		}
+	}
+
+	// otherwise call callback
+	if callback != nil {
+		return callback(msg, nil)
+	}
+
+	return nil
+}
+
+// closes an eventually created messages channel
+func (c *Client) closeMessages() {
+	c.callbackMutex.Lock()
+	defer c.callbackMutex.Unlock()
+
+	// close channel
+	if c.messages != nil && !c.messagesClosed {
+		close(c.messages)
+	}
+
+	c.messagesClosed = true
+}
+
+// returns the current callback
+func (c *Client) callback() Callback {
+	c.callbackMutex.RLock()
+	defer c.callbackMutex.RUnlock()
+
+	return c.Callback
+}
+
+// returns the logger to be used
+func (c *Client) log() LevelLogger {
+	return pickLogger(c.LevelLogger, c.Logger)
+}
+
 // sends packet and updates lastSend
 func (c *Client) send(pkt packet.Generic, async bool) error {
 	// reset keep alive tracker
 	c.tracker.Reset()
 
+	// intercept packet
+	if c.OnPacket != nil {
+		pkt = c.OnPacket(pkt, false)
+		if pkt == nil {
+			return nil
+		}
+	}
+
 	// send packet
 	err := c.conn.Send(pkt, async)
 	if err != nil {
@@ -797,13 +2369,57 @@ func (c *Client) send(pkt packet.Generic, async bool) error {
 	}
 
 	// log sent packet
-	if c.Logger != nil {
-		c.Logger(fmt.Sprintf("Sent: %s", pkt.String()))
+	c.log().Debug("Sent", "packet", pkt)
+
+	// update counters
+	c.counters.sent(pkt)
+
+	// remember send time of retransmittable packets
+	c.markSent(pkt)
+
+	// emit event
+	emit(c.Events, Event{Kind: PacketSent, Packet: pkt})
+
+	return nil
+}
+
+// sends a pingreq and queues the future that is completed with the pingresp
+func (c *Client) ping(f *future.Future) error {
+	c.pingMutex.Lock()
+	defer c.pingMutex.Unlock()
+
+	// send pingreq packet
+	err := c.send(packet.NewPingreq(), true)
+	if err != nil {
+		return err
 	}
 
+	// save ping attempt
+	c.tracker.Ping()
+	c.pings = append(c.pings, f)
+
 	return nil
 }
 
+// handles a pingresp and completes the oldest ping future
+func (c *Client) pong() {
+	c.pingMutex.Lock()
+	defer c.pingMutex.Unlock()
+
+	// save pong
+	c.tracker.Pong()
+
+	// pingresps are sent in the order of the pingreqs
+	if len(c.pings) > 0 {
+		f := c.pings[0]
+		c.pings = c.pings[1:]
+
+		if f != nil {
+			f.Complete()
+		}
+	}
+}
+
 // will try to cleanup as many resources as possible
 func (c *Client) cleanup(err error, doClose bool, possiblyClosed bool) error {
 	// cancel connect future if appropriate
@@ -812,7 +2428,7 @@ func (c *Client) cleanup(err error, doClose bool, possiblyClosed bool) error {
 	}
 
 	// set state
-	atomic.StoreUint32(&c.state, clientDisconnected)
+	previous := atomic.SwapUint32(&c.state, clientDisconnected)
 
 	// ensure that the connection gets closed
 	if doClose {
@@ -833,6 +2449,25 @@ func (c *Client) cleanup(err error, doClose bool, possiblyClosed bool) error {
 	// cancel all futures
 	c.futureStore.Clear()
 
+	// cancel all ping futures
+	c.pingMutex.Lock()
+	for _, f := range c.pings {
+		if f != nil {
+			f.Cancel()
+		}
+	}
+	c.pings = nil
+	c.pingMutex.Unlock()
+
+	// emit event once
+	if previous != clientDisconnected {
+		event := Event{Kind: Disconnected}
+		if err != nil {
+			event.Err = NewDisconnectError(err)
+		}
+		emit(c.Events, event)
+	}
+
 	return err
 }
 
@@ -841,8 +2476,8 @@ func (c *Client) die(err error, close bool, fromCallback bool) error {
 	c.finish.Do(func() {
 		err = c.cleanup(err, close, false)
 
-		if c.Callback != nil && !fromCallback {
-			returnedErr := c.Callback(nil, err)
+		if callback := c.callback(); callback != nil && !fromCallback {
+			returnedErr := callback(nil, err)
 			if returnedErr == nil {
 				err = nil
 			}
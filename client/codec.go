@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// A PayloadCodec transforms message payloads before they are published and
+// after they have been received. It is applied by the application on both
+// ends and not part of the MQTT protocol. Brokers pass the encoded payloads
+// through unchanged and all clients exchanging messages must therefore use the
+// same codec.
+type PayloadCodec interface {
+	// Encode is called with the payload of outgoing messages and returns
+	// the payload that is sent.
+	Encode(payload []byte) []byte
+
+	// Decode is called with the payload of incoming messages and returns the
+	// payload that is passed to the application.
+	Decode(payload []byte) ([]byte, error)
+}
+
+// GzipCodec is a PayloadCodec that compresses payloads using gzip.
+type GzipCodec struct {
+	// Level is the compression level used to encode payloads. It must be one
+	// of the levels supported by the gzip package, which is checked by
+	// Config.Validate.
+	//
+	// Will default to gzip.DefaultCompression if zero.
+	Level int
+}
+
+// Encode implements the PayloadCodec interface.
+func (c *GzipCodec) Encode(payload []byte) []byte {
+	// get level, invalid levels are rejected by Config.Validate
+	level := c.Level
+	if level == 0 || !c.validLevel() {
+		level = gzip.DefaultCompression
+	}
+
+	// prepare writer
+	var buf bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buf, level)
+
+	// compress payload, writing to a buffer does not fail
+	_, _ = writer.Write(payload)
+	_ = writer.Close()
+
+	return buf.Bytes()
+}
+
+// Decode implements the PayloadCodec interface.
+func (c *GzipCodec) Decode(payload []byte) ([]byte, error) {
+	// prepare reader
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	// decompress payload
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *GzipCodec) validLevel() bool {
+	return c.Level >= gzip.HuffmanOnly && c.Level <= gzip.BestCompression
+}
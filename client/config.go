@@ -1,6 +1,14 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/transport"
 )
@@ -10,28 +18,186 @@ type Dialer interface {
 	Dial(urlString string) (transport.Conn, error)
 }
 
+// The DialerFunc type is an adapter to allow the use of ordinary functions as
+// dialers, e.g. to route connections through a proxy or an in-memory pipe.
+type DialerFunc func(urlString string) (transport.Conn, error)
+
+// Dial calls f(urlString).
+func (f DialerFunc) Dial(urlString string) (transport.Conn, error) {
+	return f(urlString)
+}
+
+// A ContextDialer is a Dialer that can abort dialing when the passed context
+// gets cancelled. Custom dialers may implement this interface to support
+// Client.ConnectContext.
+type ContextDialer interface {
+	Dialer
+
+	DialContext(ctx context.Context, urlString string) (transport.Conn, error)
+}
+
 // A Config holds information about establishing a connection to a broker.
 type Config struct {
-	// Dialer can be set to use a custom dialer.
+	// Dialer can be set to use a custom dialer. The default dialer from the
+	// transport package is used if not set.
 	Dialer Dialer
 
 	// BrokerURL is the url that is used to infer options to open the connection.
 	BrokerURL string
 
-	// ClientID can be set to the clients id.
+	// TLSConfig can be set to use a custom TLS configuration when connecting
+	// to "mqtts", "tls" or "wss" brokers. The server name is derived from the
+	// broker url if missing. It is ignored if a custom dialer is set.
+	//
+	// Note: A failed TLS handshake is returned as a *transport.HandshakeError.
+	TLSConfig *tls.Config
+
+	// WebSocketHeaders can be set to send additional headers with the upgrade
+	// request when connecting to "ws" or "wss" brokers. The "mqtt" sub protocol
+	// is always requested. It is ignored if a custom dialer is set.
+	WebSocketHeaders http.Header
+
+	// WebSocketCompression can be set to negotiate the permessage-deflate
+	// extension when connecting to "ws" or "wss" brokers. Messages are only
+	// compressed if the broker supports the extension. It is ignored if a
+	// custom dialer is set.
+	WebSocketCompression bool
+
+	// ClientID can be set to the clients id. An empty id requests a clean
+	// session with an id assigned by the broker.
 	ClientID string
 
+	// AllowLongClientID can be set to skip the client id check in Validate.
+	// Brokers may allow ids that are longer than 23 characters or contain
+	// other characters than [a-zA-Z0-9].
+	AllowLongClientID bool
+
+	// Username and Password can be set to authenticate with the broker. They
+	// take precedence over credentials that are set in the broker url.
+	Username string
+	Password string
+
 	// CleanSession can be set to request a clean session.
 	CleanSession bool
 
-	// KeepAlive should be time duration string e.g. "30s".
-	KeepAlive string
+	// KeepAlive is the interval in which pings are sent if no other packets
+	// have been sent. A negative value disables the keep alive mechanism and
+	// no pings are sent. It will default to 30 seconds if zero. Config files
+	// may specify the interval as a string like "30s", see UnmarshalJSON.
+	//
+	// Note: The broker only receives whole seconds, values are rounded up so
+	// that sub-second intervals are announced as one second.
+	KeepAlive time.Duration
 
 	// Will message is registered on the broker upon connect if set.
 	WillMessage *packet.Message
 
+	// PayloadCodec can be set to transform the payloads of published messages,
+	// including the will message, and received messages, e.g. to compress
+	// them using a GzipCodec. The broker and other clients do not know about
+	// the codec and all clients that exchange messages must use the same
+	// codec. Empty payloads are passed through unchanged in both directions,
+	// so that retained messages can still be cleared. Messages with payloads
+	// that cannot be decoded are skipped and passed to OnDrop.
+	PayloadCodec PayloadCodec
+
 	// ValidateSubs will cause the client to fail if subscriptions failed.
 	ValidateSubs bool
+
+	// ValidateUnsubs will cause Unsubscribe and UnsubscribeMultiple to return
+	// ErrClientNotSubscribed if a topic filter does not exactly match a
+	// subscription that has been granted by the broker. This catches typos
+	// that would otherwise silently do nothing.
+	//
+	// Note: Subscriptions are only known once their Suback has been received.
+	ValidateUnsubs bool
+
+	// MaxInflight can be set to limit the amount of unacknowledged QOS 1 and 2
+	// messages. Publishing will block until a slot is freed by a Puback or
+	// Pubcomp. There is no limit if zero.
+	MaxInflight int
+
+	// MaxStoreBytes can be set to limit the encoded size of outgoing packets
+	// that are kept in the session while waiting for an acknowledgement. This
+	// protects publishers from growing the store unbounded if the broker is
+	// slow. Publishing will fail with ErrClientStoreFull if the limit would be
+	// exceeded. The limit is only applied if the session implements the
+	// SizedSession interface. There is no limit if zero.
+	//
+	// Note: Messages that are held in the offline queue of a Service are not
+	// counted. They are subject to the limit once they are flushed after
+	// reconnecting. A Service handles ErrClientStoreFull like any other publish
+	// error and reconnects, therefore BlockOnFullStore should be set.
+	MaxStoreBytes int
+
+	// RetransmitInterval can be set to resend outgoing Publish and Pubrel
+	// packets that have not been acknowledged within the interval while the
+	// connection stays up. The interval doubles with every retransmission of
+	// the same packet. Publish packets are resent with the dup flag set.
+	// Retransmissions are disabled if zero.
+	//
+	// Note: The MQTT 3.1.1 specification only requires resending packets after
+	// reconnecting. The broker must therefore handle duplicates.
+	RetransmitInterval time.Duration
+
+	// MaxRetransmits limits the number of retransmissions of a packet. If a
+	// packet has still not been acknowledged afterwards, it is removed from
+	// the session and the future of the message is failed with
+	// ErrClientMaxRetransmit. There is no limit if zero.
+	MaxRetransmits int
+
+	// BlockOnFullStore can be set to block publishing until enough space is
+	// available instead of failing if MaxStoreBytes would be exceeded.
+	BlockOnFullStore bool
+
+	// ManualAck can be set to acknowledge QOS 1 and 2 messages manually using
+	// Client.Ack once they have been processed. Unacknowledged messages are
+	// redelivered by the broker after reconnecting with a persistent session.
+	//
+	// Note: This option is not supported by the Service.
+	ManualAck bool
+
+	// CallbackBuffer can be set to deliver QOS 0 messages to the callback from
+	// a separate goroutine using a buffer of the specified size. This prevents
+	// a slow callback from blocking the connection and the keep alive
+	// mechanism. Messages are dropped if the buffer is full. The order of QOS 0
+	// messages relative to QOS 1 and 2 messages is not preserved.
+	CallbackBuffer int
+
+	// OnDrop is called with QOS 0 messages that have been dropped because the
+	// callback buffer was full or the client has been paused. It is also
+	// called with messages of any QOS level whose payload could not be decoded
+	// by the PayloadCodec. These messages are acknowledged and skipped.
+	OnDrop func(*packet.Message)
+
+	// OnDrain is called once all outgoing QOS 1 and 2 messages have been
+	// acknowledged and no more packets are pending in the session, e.g. to
+	// signal a batch publisher that it may disconnect. It is called every time
+	// the session becomes empty. See Client.PendingCount.
+	//
+	// Note: The function is called like the client callback and waiting on
+	// futures or disconnecting inside it will deadlock the client.
+	OnDrain func()
+
+	// OnSessionResume is called after a positive Connack has been received and
+	// before the connect future is completed. The argument reports whether the
+	// broker resumed a previous session. If not, the application may need to
+	// subscribe again.
+	//
+	// Note: The function is called like the client callback and waiting on
+	// futures inside it will deadlock the client.
+	OnSessionResume func(present bool)
+
+	// MaxPacketSize can be set to limit the size of received packets. The
+	// connection is closed and packet.ErrReadLimitExceeded is returned through
+	// the callback if the broker sends a bigger packet. The check happens
+	// before the packet is read into memory. There is no limit if zero.
+	MaxPacketSize int64
+
+	// Version can be set to packet.Version31 to connect using MQTT 3.1. It
+	// will default to packet.Version311 if zero. Other versions are currently
+	// not supported.
+	Version byte
 }
 
 // NewConfig creates a new Config using the specified URL.
@@ -39,7 +205,7 @@ func NewConfig(url string) *Config {
 	return &Config{
 		BrokerURL:    url,
 		CleanSession: true,
-		KeepAlive:    "30s",
+		KeepAlive:    30 * time.Second,
 		ValidateSubs: true,
 	}
 }
@@ -50,3 +216,145 @@ func NewConfigWithClientID(url, id string) *Config {
 	config.ClientID = id
 	return config
 }
+
+// WithCredentials sets the username and password and returns the config.
+func (c *Config) WithCredentials(username, password string) *Config {
+	c.Username = username
+	c.Password = password
+	return c
+}
+
+// WithKeepAlive sets the keep alive interval and returns the config. A negative
+// duration disables the keep alive mechanism.
+func (c *Config) WithKeepAlive(interval time.Duration) *Config {
+	c.KeepAlive = interval
+	return c
+}
+
+// WithCleanSession sets whether a clean session is requested and returns the
+// config.
+func (c *Config) WithCleanSession(clean bool) *Config {
+	c.CleanSession = clean
+	return c
+}
+
+// WithWill sets the will message and returns the config.
+func (c *Config) WithWill(topic string, payload []byte, qos packet.QOS, retain bool) *Config {
+	c.WillMessage = &packet.Message{
+		Topic:   topic,
+		Payload: payload,
+		QOS:     qos,
+		Retain:  retain,
+	}
+	return c
+}
+
+// Clone returns a copy of the config that can be modified without affecting
+// the original. The will message, TLS configuration and WebSocket headers are
+// copied as well while the dialer and callbacks are shared.
+func (c *Config) Clone() *Config {
+	// copy config
+	clone := *c
+
+	// copy will message
+	if c.WillMessage != nil {
+		clone.WillMessage = c.WillMessage.Copy()
+	}
+
+	// copy tls config
+	if c.TLSConfig != nil {
+		clone.TLSConfig = c.TLSConfig.Clone()
+	}
+
+	// copy headers
+	if c.WebSocketHeaders != nil {
+		clone.WebSocketHeaders = c.WebSocketHeaders.Clone()
+	}
+
+	return &clone
+}
+
+// UnmarshalJSON decodes the config from JSON. In addition to the number of
+// nanoseconds, KeepAlive may be specified as a string that is parsed using
+// time.ParseDuration, e.g. "30s", to support older config files.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	// prepare value, the outer field shadows the embedded one
+	type config Config
+	value := struct {
+		*config
+		KeepAlive json.RawMessage
+	}{
+		config: (*config)(c),
+	}
+
+	// decode config
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	// check keep alive
+	if len(value.KeepAlive) == 0 || string(value.KeepAlive) == "null" {
+		return nil
+	}
+
+	// parse string keep alive
+	var str string
+	if json.Unmarshal(value.KeepAlive, &str) == nil {
+		c.KeepAlive, err = time.ParseDuration(str)
+		return err
+	}
+
+	return json.Unmarshal(value.KeepAlive, &c.KeepAlive)
+}
+
+// Validate checks the config and returns ErrClientMissingID,
+// ErrClientInvalidID, ErrClientInvalidKeepAlive, ErrClientInvalidCodec or
+// ErrClientUnsupportedVersion if Connect would reject it. The client id must
+// consist of 1 to 23 characters of [a-zA-Z0-9] as required by the MQTT 3.1.1
+// specification unless AllowLongClientID is set.
+func (c *Config) Validate() error {
+	// check client id
+	if c.ClientID == "" {
+		if !c.CleanSession {
+			return ErrClientMissingID
+		}
+	} else if !c.AllowLongClientID && !validClientID(c.ClientID) {
+		return ErrClientInvalidID
+	}
+
+	// check keep alive
+	if c.KeepAlive > math.MaxUint16*time.Second {
+		return ErrClientInvalidKeepAlive
+	}
+
+	// check gzip level
+	if codec, ok := c.PayloadCodec.(*GzipCodec); ok && !codec.validLevel() {
+		return ErrClientInvalidCodec
+	}
+
+	// check version
+	if c.Version != 0 && c.Version != packet.Version311 && c.Version != packet.Version31 {
+		return ErrClientUnsupportedVersion
+	}
+
+	return nil
+}
+
+const clientIDChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func validClientID(id string) bool {
+	// check length
+	if len(id) > 23 {
+		return false
+	}
+
+	// check characters
+	for _, r := range id {
+		if !strings.ContainsRune(clientIDChars, r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,8 +1,16 @@
 package client
 
 import (
-	"github.com/stretchr/testify/assert"
+	"crypto/tls"
+	"encoding/json"
+	"math"
+	"net/http"
 	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConfig(t *testing.T) {
@@ -10,5 +18,107 @@ func TestConfig(t *testing.T) {
 	assert.Equal(t, "foo", config.BrokerURL)
 	assert.Equal(t, "", config.ClientID)
 	assert.True(t, config.CleanSession)
-	assert.Equal(t, "30s", config.KeepAlive)
+	assert.Equal(t, 30*time.Second, config.KeepAlive)
+}
+
+func TestConfigBuilder(t *testing.T) {
+	config := NewConfigWithClientID("foo", "client1").
+		WithCredentials("user", "pass").
+		WithKeepAlive(time.Minute).
+		WithCleanSession(false).
+		WithWill("will", []byte("bye"), 1, true)
+
+	assert.Equal(t, "user", config.Username)
+	assert.Equal(t, "pass", config.Password)
+	assert.Equal(t, time.Minute, config.KeepAlive)
+	assert.False(t, config.CleanSession)
+	assert.Equal(t, &packet.Message{
+		Topic:   "will",
+		Payload: []byte("bye"),
+		QOS:     1,
+		Retain:  true,
+	}, config.WillMessage)
+	assert.NoError(t, config.Validate())
+}
+
+func TestConfigClone(t *testing.T) {
+	config := NewConfig("foo").WithWill("will", []byte("bye"), 0, false)
+	config.TLSConfig = &tls.Config{ServerName: "foo"}
+	config.WebSocketHeaders = http.Header{"Foo": []string{"bar"}}
+
+	clone := config.Clone()
+	assert.Equal(t, config, clone)
+
+	clone.ClientID = "client1"
+	clone.WillMessage.Topic = "other"
+	clone.TLSConfig.ServerName = "bar"
+	clone.WebSocketHeaders.Set("Foo", "baz")
+
+	assert.Equal(t, "", config.ClientID)
+	assert.Equal(t, "will", config.WillMessage.Topic)
+	assert.Equal(t, "foo", config.TLSConfig.ServerName)
+	assert.Equal(t, "bar", config.WebSocketHeaders.Get("Foo"))
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := NewConfig("foo")
+	assert.NoError(t, config.Validate())
+
+	config.CleanSession = false
+	assert.Equal(t, ErrClientMissingID, config.Validate())
+
+	config.ClientID = "client1"
+	assert.NoError(t, config.Validate())
+
+	config.ClientID = "gomqtt/client"
+	assert.Equal(t, ErrClientInvalidID, config.Validate())
+
+	config.ClientID = "abcdefghijklmnopqrstuvwx"
+	assert.Equal(t, ErrClientInvalidID, config.Validate())
+
+	config.AllowLongClientID = true
+	assert.NoError(t, config.Validate())
+
+	config.KeepAlive = 24 * time.Hour
+	assert.Equal(t, ErrClientInvalidKeepAlive, config.Validate())
+
+	config.KeepAlive = math.MaxUint16*time.Second + time.Millisecond
+	assert.Equal(t, ErrClientInvalidKeepAlive, config.Validate())
+
+	config.KeepAlive = 500 * time.Millisecond
+	assert.NoError(t, config.Validate())
+
+	config.KeepAlive = -1
+	assert.NoError(t, config.Validate())
+
+	config.PayloadCodec = &GzipCodec{Level: 10}
+	assert.Equal(t, ErrClientInvalidCodec, config.Validate())
+
+	config.PayloadCodec = &GzipCodec{Level: 9}
+	assert.NoError(t, config.Validate())
+
+	config.Version = 5
+	assert.Equal(t, ErrClientUnsupportedVersion, config.Validate())
+}
+
+func TestConfigUnmarshalJSON(t *testing.T) {
+	var config Config
+	err := json.Unmarshal([]byte(`{"BrokerURL":"tcp://localhost:1883","KeepAlive":"2s"}`), &config)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://localhost:1883", config.BrokerURL)
+	assert.Equal(t, 2*time.Second, config.KeepAlive)
+
+	config = Config{}
+	err = json.Unmarshal([]byte(`{"KeepAlive":3000000000}`), &config)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*time.Second, config.KeepAlive)
+
+	config = Config{KeepAlive: time.Minute}
+	err = json.Unmarshal([]byte(`{"ClientID":"foo"}`), &config)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", config.ClientID)
+	assert.Equal(t, time.Minute, config.KeepAlive)
+
+	err = json.Unmarshal([]byte(`{"KeepAlive":"foo"}`), &config)
+	assert.Error(t, err)
 }
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// EventKind denotes the kind of an Event.
+type EventKind int
+
+const (
+	// Connected is emitted when the client received a positive Connack.
+	Connected EventKind = iota
+
+	// Disconnected is emitted when the connection has been closed. The error
+	// is set to a *DisconnectError if the connection has not been closed
+	// cleanly.
+	Disconnected
+
+	// PacketSent is emitted after a packet has been sent.
+	PacketSent
+
+	// PacketReceived is emitted after a packet has been received.
+	PacketReceived
+
+	// Reconnecting is emitted by the service before it attempts to reconnect.
+	Reconnecting
+)
+
+// String returns the name of the event kind.
+func (k EventKind) String() string {
+	switch k {
+	case Connected:
+		return "Connected"
+	case Disconnected:
+		return "Disconnected"
+	case PacketSent:
+		return "PacketSent"
+	case PacketReceived:
+		return "PacketReceived"
+	case Reconnecting:
+		return "Reconnecting"
+	}
+
+	return "Unknown"
+}
+
+// An Event describes a change in the lifecycle of a client or service.
+type Event struct {
+	// The kind of the event.
+	Kind EventKind
+
+	// The sent or received packet for PacketSent and PacketReceived events.
+	Packet packet.Generic
+
+	// The *DisconnectError that caused a Disconnected event.
+	Err error
+
+	// The reconnect attempt for Reconnecting events.
+	Attempt int
+}
+
+// DisconnectReason classifies the cause of a disconnect.
+type DisconnectReason int
+
+const (
+	// DisconnectClient denotes errors raised by the client itself, its
+	// session or the callback.
+	DisconnectClient DisconnectReason = iota
+
+	// DisconnectDenied denotes a connection that has been denied by the
+	// broker, e.g. due to invalid credentials.
+	DisconnectDenied
+
+	// DisconnectKeepAlive denotes a connection that has been closed because
+	// the broker did not answer a ping in time.
+	DisconnectKeepAlive
+
+	// DisconnectServer denotes a connection that has been closed by the
+	// broker. MQTT 3.1.1 brokers do not send a reason and simply close the
+	// connection, e.g. if a client with the same id connected.
+	DisconnectServer
+
+	// DisconnectProtocol denotes an invalid or unexpected packet that has
+	// been received from the broker.
+	DisconnectProtocol
+
+	// DisconnectTransport denotes a failed connection, e.g. a network error.
+	DisconnectTransport
+)
+
+// String returns the name of the disconnect reason.
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClient:
+		return "Client"
+	case DisconnectDenied:
+		return "Denied"
+	case DisconnectKeepAlive:
+		return "KeepAlive"
+	case DisconnectServer:
+		return "Server"
+	case DisconnectProtocol:
+		return "Protocol"
+	case DisconnectTransport:
+		return "Transport"
+	}
+
+	return "Unknown"
+}
+
+// A DisconnectError wraps the error that caused a disconnect together with its
+// classification.
+type DisconnectError struct {
+	// The classification of the error.
+	Reason DisconnectReason
+
+	// The underlying error.
+	Err error
+}
+
+// NewDisconnectError classifies the specified error. It can be used to
+// classify errors that are passed to the Callback.
+func NewDisconnectError(err error) *DisconnectError {
+	// get reason
+	var reason DisconnectReason
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrClientConnectionDenied):
+		reason = DisconnectDenied
+	case errors.Is(err, ErrClientMissingPong):
+		reason = DisconnectKeepAlive
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		reason = DisconnectServer
+	case errors.Is(err, ErrClientExpectedConnack),
+		errors.Is(err, packet.ErrMalformedPacket),
+		errors.Is(err, packet.ErrReadLimitExceeded),
+		errors.Is(err, packet.ErrDetectionOverflow),
+		errors.Is(err, packet.ErrInvalidPacketType):
+		reason = DisconnectProtocol
+	case errors.As(err, &netErr):
+		reason = DisconnectTransport
+	}
+
+	return &DisconnectError{
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+// Error implements the error interface.
+func (e *DisconnectError) Error() string {
+	return e.Reason.String() + " disconnect: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *DisconnectError) Unwrap() error {
+	return e.Err
+}
+
+// Transient returns whether the disconnect has been caused by a condition that
+// may resolve by itself and reconnecting is reasonable.
+func (e *DisconnectError) Transient() bool {
+	switch e.Reason {
+	case DisconnectKeepAlive, DisconnectServer, DisconnectTransport:
+		return true
+	}
+
+	return false
+}
+
+// emit will send the event without blocking. The event is dropped if the
+// channel is nil or not ready to receive.
+func emit(events chan<- Event, event Event) {
+	if events == nil {
+		return
+	}
+
+	select {
+	case events <- event:
+	default:
+	}
+}
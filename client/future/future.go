@@ -20,6 +20,8 @@ type Future struct {
 
 	completeChannel chan struct{}
 	cancelChannel   chan struct{}
+	err             error
+	once            sync.Once
 }
 
 // New will return a new Future.
@@ -31,52 +33,68 @@ func New() *Future {
 }
 
 // Bind will tie the current future to the specified future. If the bound to
-// future is completed or canceled the current will as well. Data saved in the
-// bound future is copied to the current on complete and cancel.
+// future is completed, canceled or failed the current will as well. Data saved
+// in the bound future is copied to the current on complete and cancel.
 func (f *Future) Bind(f2 *Future) {
 	select {
 	case <-f2.completeChannel:
-		f.Data = f2.Data
-		close(f.completeChannel)
+		f.once.Do(func() {
+			f.Data = f2.Data
+			close(f.completeChannel)
+		})
 	case <-f2.cancelChannel:
-		f.Data = f2.Data
-		close(f.cancelChannel)
+		f.once.Do(func() {
+			f.Data = f2.Data
+			f.err = f2.err
+			close(f.cancelChannel)
+		})
 	}
 }
 
-// Wait will wait the given amount of time and return whether the future has been
-// completed, canceled or the request timed out.
+// Wait will wait the given amount of time and return whether the future has
+// been completed, canceled, failed or the request timed out. A timeout does not
+// affect the future itself, which may still be completed or canceled later.
 func (f *Future) Wait(timeout time.Duration) error {
+	// prepare timer that is released when the future resolves early
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	select {
 	case <-f.completeChannel:
 		return nil
 	case <-f.cancelChannel:
+		if f.err != nil {
+			return f.err
+		}
+
 		return ErrCanceled
-	case <-time.After(timeout):
+	case <-timer.C:
 		return ErrTimeout
 	}
 }
 
-// Complete will complete the future.
+// Complete will complete the future. It has no effect if the future has
+// already been completed, canceled or failed.
 func (f *Future) Complete() {
-	// return if future has already been canceled
-	select {
-	case <-f.cancelChannel:
-		return
-	default:
-	}
-
-	close(f.completeChannel)
+	f.once.Do(func() {
+		close(f.completeChannel)
+	})
 }
 
-// Cancel will cancel the future.
+// Cancel will cancel the future. It has no effect if the future has already
+// been completed, canceled or failed.
 func (f *Future) Cancel() {
-	// return if future has already been completed
-	select {
-	case <-f.completeChannel:
-		return
-	default:
-	}
+	f.once.Do(func() {
+		close(f.cancelChannel)
+	})
+}
 
-	close(f.cancelChannel)
+// Fail will cancel the future with the specified error, which is returned by
+// Wait instead of ErrCanceled. It has no effect if the future has already been
+// completed, canceled or failed.
+func (f *Future) Fail(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.cancelChannel)
+	})
 }
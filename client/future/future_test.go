@@ -1,6 +1,9 @@
 package future
 
 import (
+	"errors"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,6 +16,39 @@ func TestFutureCompleteBefore(t *testing.T) {
 	assert.NoError(t, f.Wait(10*time.Millisecond))
 }
 
+func TestFutureWaitReleasesTimer(t *testing.T) {
+	f := New()
+	f.Complete()
+
+	runtime.GC()
+	goroutines := runtime.NumGoroutine()
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	// wait concurrently on a resolved future with a long timeout
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				assert.NoError(t, f.Wait(time.Hour))
+			}
+		}()
+	}
+	wg.Wait()
+
+	runtime.GC()
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	// check that neither goroutines nor timers are left behind
+	assert.Equal(t, goroutines, runtime.NumGoroutine())
+	assert.True(t, after.HeapObjects < before.HeapObjects+10000)
+}
+
 func TestFutureCompleteAfter(t *testing.T) {
 	done := make(chan struct{})
 
@@ -49,6 +85,32 @@ func TestFutureCancelAfter(t *testing.T) {
 	<-done
 }
 
+func TestFutureFail(t *testing.T) {
+	err := errors.New("foo")
+
+	f := New()
+	f.Fail(err)
+	assert.Equal(t, err, f.Wait(10*time.Millisecond))
+
+	f2 := New()
+	f2.Bind(f)
+	assert.Equal(t, err, f2.Wait(10*time.Millisecond))
+}
+
+func TestFutureFailAfterCancel(t *testing.T) {
+	f := New()
+	f.Cancel()
+	f.Fail(errors.New("foo"))
+	f.Cancel()
+	f.Complete()
+	assert.Equal(t, ErrCanceled, f.Wait(10*time.Millisecond))
+
+	f = New()
+	f.Fail(errors.New("foo"))
+	f.Cancel()
+	assert.Equal(t, errors.New("foo"), f.Wait(10*time.Millisecond))
+}
+
 func TestFutureTimeout(t *testing.T) {
 	f := New()
 	assert.Equal(t, ErrTimeout, f.Wait(1*time.Millisecond))
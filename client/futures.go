@@ -13,7 +13,8 @@ type GenericFuture interface {
 	// future.ErrCanceled if the future gets canceled. If the timeout is reached,
 	// future.ErrTimeoutExceeded is returned.
 	//
-	// Note: Wait will not return any Client related errors.
+	// Note: Wait will not return any Client related errors except
+	// ErrClientMaxRetransmit for publish futures.
 	Wait(timeout time.Duration) error
 }
 
@@ -34,6 +35,12 @@ type SubscribeFuture interface {
 
 	// ReturnCodes will return the suback codes returned by the broker.
 	ReturnCodes() []packet.QOS
+
+	// GrantedQOS will return the QOS granted by the broker for the specified
+	// topic filter. The returned QOS may be packet.QOSFailure. False is
+	// returned if the future has not yet been completed or the topic has not
+	// been requested.
+	GrantedQOS(topic string) (packet.QOS, bool)
 }
 
 type futureKey int
@@ -42,6 +49,7 @@ const (
 	sessionPresentKey futureKey = iota
 	returnCodeKey
 	returnCodesKey
+	subscriptionsKey
 )
 
 type connectFuture struct {
@@ -78,3 +86,22 @@ func (f *subscribeFuture) ReturnCodes() []packet.QOS {
 
 	return v.([]packet.QOS)
 }
+
+func (f *subscribeFuture) GrantedQOS(topic string) (packet.QOS, bool) {
+	v, ok := f.Data.Load(subscriptionsKey)
+	if !ok {
+		return 0, false
+	}
+
+	// get return codes
+	returnCodes := f.ReturnCodes()
+
+	// find subscription
+	for i, sub := range v.([]packet.Subscription) {
+		if sub.Topic == topic && i < len(returnCodes) {
+			return returnCodes[i], true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A LevelLogger is used by the client and service to log levelled messages.
+// The additional key value pairs describe the logged message further and can
+// be used to integrate with structured logging libraries.
+type LevelLogger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// A Logger is a function called by the client to log activity. It implements
+// the LevelLogger interface by ignoring the level and appending the key value
+// pairs to the message.
+type Logger func(msg string)
+
+// Debug implements the LevelLogger interface.
+func (l Logger) Debug(msg string, kv ...interface{}) {
+	l(format(msg, kv))
+}
+
+// Info implements the LevelLogger interface.
+func (l Logger) Info(msg string, kv ...interface{}) {
+	l(format(msg, kv))
+}
+
+// Warn implements the LevelLogger interface.
+func (l Logger) Warn(msg string, kv ...interface{}) {
+	l(format(msg, kv))
+}
+
+// Error implements the LevelLogger interface.
+func (l Logger) Error(msg string, kv ...interface{}) {
+	l(format(msg, kv))
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// returns the level logger if set, the adapted logger function otherwise and
+// falls back to a logger that discards all messages
+func pickLogger(levelLogger LevelLogger, logger Logger) LevelLogger {
+	if levelLogger != nil {
+		return levelLogger
+	} else if logger != nil {
+		return logger
+	}
+
+	return nopLogger{}
+}
+
+func format(msg string, kv []interface{}) string {
+	// check pairs
+	if len(kv) == 0 {
+		return msg
+	}
+
+	// prepare builder
+	var b strings.Builder
+	b.WriteString(msg)
+
+	// append pairs
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 < len(kv) {
+			fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", kv[i])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var messages []string
+	var l LevelLogger = Logger(func(msg string) {
+		messages = append(messages, msg)
+	})
+
+	l.Debug("foo")
+	l.Info("foo", "bar", 42)
+	l.Warn("foo", "bar", "baz", "qux")
+	l.Error("foo", "bar", nil)
+
+	assert.Equal(t, []string{
+		"foo",
+		"foo bar=42",
+		"foo bar=baz qux",
+		"foo bar=<nil>",
+	}, messages)
+}
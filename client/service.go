@@ -1,7 +1,6 @@
 package client
 
 import (
-	"fmt"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -53,6 +52,14 @@ type ErrorCallback func(error)
 // means that waiting on a future inside the callback will deadlock the service.
 type OfflineCallback func()
 
+// A ReconnectCallback is a function that is called before the service attempts
+// to reconnect. The attempt counter starts at one and is reset once a
+// connection has been established successfully.
+//
+// Note: Execution of the service is resumed after the callback returns. This
+// means that waiting on a future inside the callback will deadlock the service.
+type ReconnectCallback func(attempt int)
+
 const (
 	serviceStarted uint32 = iota
 	serviceStopped
@@ -86,11 +93,27 @@ type Service struct {
 	// The callback that is used to notify that the service is offline.
 	OfflineCallback OfflineCallback
 
+	// The callback that is used to notify that the service will attempt to
+	// reconnect.
+	ReconnectCallback ReconnectCallback
+
 	// The logger that is used to log write low level information like packets
 	// that have ben successfully sent and received, details about the
 	// automatic keep alive handler, reconnection and occurring errors.
 	Logger Logger
 
+	// The levelled logger that is used instead of Logger if set. It is also
+	// passed to the underlying clients.
+	LevelLogger LevelLogger
+
+	// The interceptor that is passed to the underlying clients to observe or
+	// modify all sent and received packets.
+	OnPacket Interceptor
+
+	// The channel that receives lifecycle events of the service and the
+	// underlying clients. Events get dropped if the channel is not ready.
+	Events chan<- Event
+
 	// The minimum delay between reconnects.
 	//
 	// Note: The value must be changed before calling Start.
@@ -101,6 +124,13 @@ type Service struct {
 	// Note: The value must be changed before calling Start.
 	MaxReconnectDelay time.Duration
 
+	// Whether the delay between reconnects should be randomized to ease
+	// contention when many clients reconnect at the same time. It is disabled
+	// by default to keep the reconnect delays deterministic.
+	//
+	// Note: The value must be changed before calling Start.
+	ReconnectJitter bool
+
 	// The allowed timeout until a connection attempt is canceled.
 	ConnectTimeout time.Duration
 
@@ -116,10 +146,35 @@ type Service struct {
 	// configured to request one.
 	ResubscribeAllSubscriptions bool
 
+	// Whether messages published while the service is offline should be kept
+	// in a separate queue that is flushed once a connection has been
+	// established. The futures of queued QOS 0 messages are completed
+	// immediately. Messages that are rejected when flushed, e.g. because of
+	// an invalid topic, are dropped and their futures are canceled.
+	OfflineQueueing bool
+
+	// The maximum number of messages kept in the offline queue. If the queue is
+	// full, the oldest queued QOS 0 message or otherwise the new QOS 0 message
+	// is dropped. QOS 1 and 2 messages are never dropped and may therefore
+	// exceed the limit. There is no limit if zero.
+	MaxOfflineQueue int
+
+	// Additional broker urls that are tried in order after Config.BrokerURL if
+	// a connection cannot be established. The service remembers the url of
+	// the last successful connection and continues with the next url if a
+	// connection attempt fails.
+	FailoverURLs []string
+
 	backoff       *backoff.Backoff
+	current       int
 	subscriptions *topic.Tree
 	commandQueue  chan *command
 	futureStore   *future.Store
+	counters      *counters
+
+	online       bool
+	offlineQueue []*command
+	offlineMutex sync.Mutex
 
 	mutex sync.Mutex
 	tomb  *tomb.Tomb
@@ -146,6 +201,7 @@ func NewService(queueSize ...int) *Service {
 		subscriptions:               topic.NewTree(),
 		commandQueue:                make(chan *command, qs),
 		futureStore:                 future.NewStore(),
+		counters:                    &counters{},
 	}
 }
 
@@ -175,6 +231,7 @@ func (s *Service) Start(config *Config) {
 		Min:    s.MinReconnectDelay,
 		Max:    s.MaxReconnectDelay,
 		Factor: 2,
+		Jitter: s.ReconnectJitter,
 	}
 
 	// mark future store as protected
@@ -211,6 +268,11 @@ func (s *Service) PublishMessage(msg *packet.Message) GenericFuture {
 	// allocate future
 	f := future.New()
 
+	// queue publish in offline queue if enabled
+	if s.OfflineQueueing && s.enqueue(msg, f) {
+		return f
+	}
+
 	// queue publish
 	s.commandQueue <- &command{
 		publish: true,
@@ -315,9 +377,36 @@ func (s *Service) Stop(clearFutures bool) {
 	atomic.StoreUint32(&s.state, serviceStopped)
 }
 
+// State returns the current connection state of the service. A started
+// service is connecting until a connection has been established and all
+// subscriptions have been restored.
+func (s *Service) State() State {
+	// check if stopped
+	if atomic.LoadUint32(&s.state) != serviceStarted {
+		return StateDisconnected
+	}
+
+	s.offlineMutex.Lock()
+	defer s.offlineMutex.Unlock()
+
+	// check if online
+	if s.online {
+		return StateConnected
+	}
+
+	return StateConnecting
+}
+
+// Stats returns a snapshot of the counters accumulated over all connections
+// of the service.
+func (s *Service) Stats() Stats {
+	return s.counters.snapshot(s.Session)
+}
+
 // the supervised reconnect loop
 func (s *Service) supervisor() error {
 	first := true
+	attempt := 0
 
 	for {
 		if first {
@@ -326,7 +415,7 @@ func (s *Service) supervisor() error {
 		} else {
 			// get backoff duration
 			d := s.backoff.Duration()
-			s.log(fmt.Sprintf("Delay Reconnect: %v", d))
+			s.log().Info("Delay Reconnect", "duration", d)
 
 			// sleep but return on Stop
 			select {
@@ -334,9 +423,21 @@ func (s *Service) supervisor() error {
 			case <-s.tomb.Dying():
 				return tomb.ErrDying
 			}
+
+			// increment attempt
+			attempt++
+			atomic.AddUint64(&s.counters.reconnects, 1)
+
+			// run callback
+			if s.ReconnectCallback != nil {
+				s.ReconnectCallback(attempt)
+			}
+
+			// emit event
+			emit(s.Events, Event{Kind: Reconnecting, Attempt: attempt})
 		}
 
-		s.log("Next Reconnect")
+		s.log().Info("Next Reconnect")
 
 		// prepare the stop channel
 		fail := make(chan struct{})
@@ -354,6 +455,15 @@ func (s *Service) supervisor() error {
 			}
 		}
 
+		// flush offline queue
+		if !s.flush(client) {
+			continue
+		}
+
+		// reset backoff and attempt counter
+		s.backoff.Reset()
+		attempt = 0
+
 		// run callback
 		if s.OnlineCallback != nil {
 			s.OnlineCallback(resumed)
@@ -362,6 +472,11 @@ func (s *Service) supervisor() error {
 		// run dispatcher on client
 		dying := s.dispatcher(client, fail)
 
+		// mark offline
+		s.offlineMutex.Lock()
+		s.online = false
+		s.offlineMutex.Unlock()
+
 		// run callback
 		if s.OfflineCallback != nil {
 			s.OfflineCallback()
@@ -380,7 +495,11 @@ func (s *Service) connect(fail chan struct{}) (*Client, bool) {
 	client := New()
 	client.Session = s.Session
 	client.Logger = s.Logger
+	client.LevelLogger = s.LevelLogger
+	client.OnPacket = s.OnPacket
+	client.Events = s.Events
 	client.futureStore = s.futureStore
+	client.counters = s.counters
 
 	// set callback
 	client.Callback = func(msg *packet.Message, err error) error {
@@ -398,18 +517,39 @@ func (s *Service) connect(fail chan struct{}) (*Client, bool) {
 		return nil
 	}
 
+	// prepare urls starting with the current url
+	urls := append([]string{s.config.BrokerURL}, s.FailoverURLs...)
+	ordered := make([]string, 0, len(urls))
+	for i := range urls {
+		ordered = append(ordered, urls[(s.current+i)%len(urls)])
+	}
+
+	// continue with the next url if the attempt fails
+	failover := func() {
+		s.current = (s.current + 1) % len(urls)
+	}
+
 	// attempt to connect
-	connectFuture, err := client.Connect(s.config)
+	connectFuture, err := client.ConnectAny(ordered, s.config)
 	if err != nil {
+		failover()
 		s.err("Connect", err)
 		return nil, false
 	}
 
+	// remember used url
+	for i, u := range urls {
+		if u == client.BrokerURL() {
+			s.current = i
+		}
+	}
+
 	// wait for connack
 	err = connectFuture.Wait(s.ConnectTimeout)
 
 	// check if future has been canceled
 	if err == future.ErrCanceled {
+		failover()
 		s.err("Connect", err)
 		return nil, false
 	}
@@ -418,6 +558,7 @@ func (s *Service) connect(fail chan struct{}) (*Client, bool) {
 	if err == future.ErrTimeout {
 		client.Close()
 
+		failover()
 		s.err("Connect", err)
 		return nil, false
 	}
@@ -470,6 +611,95 @@ func (s *Service) resubscribe(client *Client) bool {
 	return true
 }
 
+// adds the message to the offline queue if the service is offline
+func (s *Service) enqueue(msg *packet.Message, f *future.Future) bool {
+	s.offlineMutex.Lock()
+	defer s.offlineMutex.Unlock()
+
+	// check if online
+	if s.online {
+		return false
+	}
+
+	// make room if the queue is full
+	if s.MaxOfflineQueue > 0 && len(s.offlineQueue) >= s.MaxOfflineQueue {
+		dropped := false
+
+		// drop oldest QOS 0 message
+		for i, cmd := range s.offlineQueue {
+			if cmd.message.QOS == 0 {
+				s.offlineQueue = append(s.offlineQueue[:i], s.offlineQueue[i+1:]...)
+				dropped = true
+				break
+			}
+		}
+
+		// otherwise drop new QOS 0 message
+		if !dropped && msg.QOS == 0 {
+			s.log().Warn("Dropped Offline Message", "topic", msg.Topic)
+			f.Complete()
+			return true
+		}
+	}
+
+	// queue publish
+	s.offlineQueue = append(s.offlineQueue, &command{
+		publish: true,
+		future:  f,
+		message: msg,
+	})
+
+	// complete QOS 0 messages immediately
+	if msg.QOS == 0 {
+		f.Complete()
+	}
+
+	return true
+}
+
+// marks the service online and publishes all messages in the offline queue
+func (s *Service) flush(client *Client) bool {
+	// mark online and get queue
+	s.offlineMutex.Lock()
+	s.online = true
+	queue := s.offlineQueue
+	s.offlineQueue = nil
+	s.offlineMutex.Unlock()
+
+	for i, cmd := range queue {
+		f2, err := client.PublishMessage(cmd.message)
+		if err == ErrInvalidTopic || err == ErrClientStoreFull {
+			s.err("Publish", err)
+
+			// cancel future as the message will never be accepted
+			cmd.future.Cancel()
+
+			continue
+		} else if err != nil {
+			s.err("Publish", err)
+
+			// mark offline and requeue remaining messages
+			s.offlineMutex.Lock()
+			s.online = false
+			s.offlineQueue = append(queue[i:], s.offlineQueue...)
+			s.offlineMutex.Unlock()
+
+			// close client to release the connection
+			client.Close()
+
+			return false
+		}
+
+		// bind future of QOS 1 and 2 messages in a own goroutine. the
+		// goroutine will be ultimately collected when the service is stopped
+		if cmd.message.QOS > 0 {
+			go cmd.future.Bind(f2.(*future.Future))
+		}
+	}
+
+	return true
+}
+
 // reads from the queues and calls the current client
 func (s *Service) dispatcher(client *Client, fail chan struct{}) bool {
 	for {
@@ -541,15 +771,13 @@ func (s *Service) dispatcher(client *Client, fail chan struct{}) bool {
 }
 
 func (s *Service) err(sys string, err error) {
-	s.log(fmt.Sprintf("%s Error: %s", sys, err.Error()))
+	s.log().Error(sys+" Error", "error", err)
 
 	if s.ErrorCallback != nil {
 		s.ErrorCallback(err)
 	}
 }
 
-func (s *Service) log(str string) {
-	if s.Logger != nil {
-		s.Logger(str)
-	}
+func (s *Service) log() LevelLogger {
+	return pickLogger(s.LevelLogger, s.Logger)
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/256dpi/gomqtt/client/future"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/transport/flow"
 
@@ -60,17 +61,29 @@ func TestServicePublishSubscribe(t *testing.T) {
 		return nil
 	}
 
+	assert.Equal(t, StateDisconnected, s.State())
+
 	s.Start(NewConfig("tcp://localhost:" + port))
 
 	safeReceive(online)
 
-	assert.NoError(t, s.Subscribe("test", 0).Wait(1*time.Second))
+	assert.Equal(t, StateConnected, s.State())
+
+	subscribeFuture := s.Subscribe("test", 0)
+	assert.NoError(t, subscribeFuture.Wait(1*time.Second))
+
+	qos, ok := subscribeFuture.GrantedQOS("test")
+	assert.True(t, ok)
+	assert.Equal(t, packet.QOS(0), qos)
+
 	assert.NoError(t, s.Publish("test", []byte("test"), 0, false).Wait(1*time.Second))
 
 	safeReceive(message)
 
 	s.Stop(true)
 
+	assert.Equal(t, StateDisconnected, s.State())
+
 	safeReceive(offline)
 	safeReceive(done)
 }
@@ -217,6 +230,117 @@ func TestServiceUnsubscribe(t *testing.T) {
 	safeReceive(done)
 }
 
+func TestServiceOfflineQueueing(t *testing.T) {
+	publish1 := packet.NewPublish()
+	publish1.Message.Topic = "test"
+	publish1.Message.Payload = []byte("2")
+	publish1.Message.QOS = 1
+	publish1.ID = 1
+
+	publish2 := packet.NewPublish()
+	publish2.Message.Topic = "test"
+	publish2.Message.Payload = []byte("3")
+
+	puback := packet.NewPuback()
+	puback.ID = 1
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(publish1).
+		Receive(publish2).
+		Send(puback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	online := make(chan struct{})
+	offline := make(chan struct{})
+
+	s := NewService()
+	s.OfflineQueueing = true
+	s.MaxOfflineQueue = 2
+
+	s.OnlineCallback = func(resumed bool) {
+		close(online)
+	}
+
+	s.OfflineCallback = func() {
+		close(offline)
+	}
+
+	publishFuture1 := s.Publish("test", []byte("1"), 0, false)
+	assert.NoError(t, publishFuture1.Wait(10*time.Millisecond))
+
+	publishFuture2 := s.Publish("test", []byte("2"), 1, false)
+	assert.Equal(t, future.ErrTimeout, publishFuture2.Wait(10*time.Millisecond))
+
+	publishFuture3 := s.Publish("test", []byte("3"), 0, false)
+	assert.NoError(t, publishFuture3.Wait(10*time.Millisecond))
+
+	s.Start(NewConfig("tcp://localhost:" + port))
+
+	safeReceive(online)
+
+	assert.NoError(t, publishFuture2.Wait(1*time.Second))
+
+	s.Stop(true)
+
+	safeReceive(offline)
+	safeReceive(done)
+}
+
+func TestServiceOfflineQueueingInvalidTopic(t *testing.T) {
+	publish := packet.NewPublish()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("2")
+	publish.Message.QOS = 1
+	publish.ID = 1
+
+	puback := packet.NewPuback()
+	puback.ID = 1
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(publish).
+		Send(puback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	online := make(chan struct{})
+	offline := make(chan struct{})
+
+	s := NewService()
+	s.OfflineQueueing = true
+
+	s.OnlineCallback = func(resumed bool) {
+		close(online)
+	}
+
+	s.OfflineCallback = func() {
+		close(offline)
+	}
+
+	publishFuture1 := s.Publish("test/#", []byte("1"), 1, false)
+	publishFuture2 := s.Publish("test", []byte("2"), 1, false)
+
+	s.Start(NewConfig("tcp://localhost:" + port))
+
+	safeReceive(online)
+
+	assert.Equal(t, future.ErrCanceled, publishFuture1.Wait(1*time.Second))
+	assert.NoError(t, publishFuture2.Wait(1*time.Second))
+
+	s.Stop(true)
+
+	safeReceive(offline)
+	safeReceive(done)
+}
+
 func TestServiceReconnect(t *testing.T) {
 	delay := flow.New().
 		Receive(connectPacket()).
@@ -268,6 +392,97 @@ func TestServiceReconnect(t *testing.T) {
 	assert.Equal(t, 4, i)
 }
 
+func TestServiceReconnectCallback(t *testing.T) {
+	delay := flow.New().
+		Receive(connectPacket()).
+		Run(func() {
+			time.Sleep(55 * time.Millisecond)
+		}).
+		End()
+
+	noDelay := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, delay, delay, noDelay)
+
+	online := make(chan struct{})
+	offline := make(chan struct{})
+
+	s := NewService()
+	s.ConnectTimeout = 50 * time.Millisecond
+
+	var attempts []int
+	s.ReconnectCallback = func(attempt int) {
+		attempts = append(attempts, attempt)
+	}
+
+	s.OnlineCallback = func(resumed bool) {
+		close(online)
+	}
+
+	s.OfflineCallback = func() {
+		close(offline)
+	}
+
+	s.Start(NewConfig("tcp://localhost:" + port))
+
+	safeReceive(online)
+
+	s.Stop(true)
+
+	safeReceive(offline)
+	safeReceive(done)
+
+	assert.Equal(t, []int{1, 2}, attempts)
+	assert.Equal(t, uint64(2), s.Stats().Reconnects)
+}
+
+func TestServiceFailover(t *testing.T) {
+	delay := flow.New().
+		Receive(connectPacket()).
+		Run(func() {
+			time.Sleep(55 * time.Millisecond)
+		}).
+		End()
+
+	noDelay := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	done1, port1 := fakeBroker(t, delay)
+	done2, port2 := fakeBroker(t, noDelay)
+
+	online := make(chan struct{})
+	offline := make(chan struct{})
+
+	s := NewService()
+	s.ConnectTimeout = 50 * time.Millisecond
+	s.FailoverURLs = []string{"tcp://localhost:" + port2}
+
+	s.OnlineCallback = func(resumed bool) {
+		close(online)
+	}
+
+	s.OfflineCallback = func() {
+		close(offline)
+	}
+
+	s.Start(NewConfig("tcp://localhost:" + port1))
+
+	safeReceive(online)
+
+	s.Stop(true)
+
+	safeReceive(offline)
+	safeReceive(done1)
+	safeReceive(done2)
+}
+
 func TestServiceResubscribe(t *testing.T) {
 	subscribe1 := packet.NewSubscribe()
 	subscribe1.Subscriptions = []packet.Subscription{{Topic: "overlap/#", QOS: 0}}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/session"
+)
+
+// Stats is a snapshot of the counters maintained by a client or service.
+type Stats struct {
+	// The number of messages that have been published.
+	MessagesPublished uint64
+
+	// The number of messages that have been received.
+	MessagesReceived uint64
+
+	// The number of bytes that have been sent and received.
+	BytesSent     uint64
+	BytesReceived uint64
+
+	// The number of reconnect attempts made by a service.
+	Reconnects uint64
+
+	// The number of outgoing packets that are stored in the session and wait
+	// for an acknowledgement.
+	Inflight int
+}
+
+type counters struct {
+	messagesPublished uint64
+	messagesReceived  uint64
+	bytesSent         uint64
+	bytesReceived     uint64
+	reconnects        uint64
+}
+
+func (c *counters) sent(pkt packet.Generic) {
+	atomic.AddUint64(&c.bytesSent, uint64(pkt.Len()))
+
+	if publish, ok := pkt.(*packet.Publish); ok && !publish.Dup {
+		atomic.AddUint64(&c.messagesPublished, 1)
+	}
+}
+
+func (c *counters) received(pkt packet.Generic) {
+	atomic.AddUint64(&c.bytesReceived, uint64(pkt.Len()))
+
+	if publish, ok := pkt.(*packet.Publish); ok && !publish.Dup {
+		atomic.AddUint64(&c.messagesReceived, 1)
+	}
+}
+
+func (c *counters) snapshot(sess Session) Stats {
+	// get stats
+	stats := Stats{
+		MessagesPublished: atomic.LoadUint64(&c.messagesPublished),
+		MessagesReceived:  atomic.LoadUint64(&c.messagesReceived),
+		BytesSent:         atomic.LoadUint64(&c.bytesSent),
+		BytesReceived:     atomic.LoadUint64(&c.bytesReceived),
+		Reconnects:        atomic.LoadUint64(&c.reconnects),
+	}
+
+	// count inflight packets
+	if sess != nil {
+		packets, err := sess.AllPackets(session.Outgoing)
+		if err == nil {
+			stats.Inflight = len(packets)
+		}
+	}
+
+	return stats
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -57,6 +58,39 @@ func fakeBroker(t *testing.T, testFlows ...*flow.Flow) (chan struct{}, string) {
 	return done, port
 }
 
+// pipeBroker works like fakeBroker but serves the flows over in-memory pipes.
+// The returned dialer must be set on the config and ignores the broker url.
+func pipeBroker(t *testing.T, testFlows ...*flow.Flow) (chan struct{}, Dialer) {
+	done := make(chan struct{})
+	conns := make(chan transport.Conn)
+
+	go func() {
+		for _, flow := range testFlows {
+			err := flow.Test(<-conns)
+			assert.NoError(t, err)
+		}
+
+		close(done)
+	}()
+
+	dialer := DialerFunc(func(string) (transport.Conn, error) {
+		conn1, conn2 := transport.Pipe()
+		conns <- conn2
+		return conn1, nil
+	})
+
+	return done, dialer
+}
+
+// rawPacket can be sent by a flow to write arbitrary bytes to the connection.
+type rawPacket []byte
+
+func (p rawPacket) Type() packet.Type              { return 0 }
+func (p rawPacket) Len() int                       { return len(p) }
+func (p rawPacket) Decode(src []byte) (int, error) { return 0, nil }
+func (p rawPacket) Encode(dst []byte) (int, error) { return copy(dst, p), nil }
+func (p rawPacket) String() string                 { return fmt.Sprintf("<Raw %v>", []byte(p)) }
+
 func connectPacket() *packet.Connect {
 	pkt := packet.NewConnect()
 	pkt.CleanSession = true
@@ -84,6 +84,7 @@ func connect(id string) *client.Client {
 
 	cfg := client.NewConfig(*broker)
 	cfg.ClientID = "gomqtt-benchmark/" + id
+	cfg.AllowLongClientID = true
 
 	cf, err := cl.Connect(cfg)
 	if err != nil {
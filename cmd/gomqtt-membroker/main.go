@@ -18,6 +18,8 @@ import (
 
 var url = flag.String("url", "tcp://0.0.0.0:1883", "broker url")
 var sqz = flag.Int("sqz", 100, "session queue size")
+var retained = flag.String("retained", "", "retained messages directory")
+var sessions = flag.String("sessions", "", "stored sessions directory")
 
 func main() {
 	flag.Parse()
@@ -38,6 +40,25 @@ func main() {
 	backend := broker.NewMemoryBackend()
 	backend.SessionQueueSize = *sqz
 
+	if *retained != "" {
+		backend.Retained, err = broker.OpenFileRetainedStore(*retained)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *sessions != "" {
+		backend.Sessions, err = broker.OpenFileSessionStore(*sessions)
+		if err != nil {
+			panic(err)
+		}
+
+		err = backend.LoadSessions()
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	var published int32
 	var forwarded int32
 	var clients int32
@@ -109,7 +109,7 @@ func (cp *Connect) Decode(src []byte) (int, error) {
 
 	// check protocol string and version
 	if versionByte != Version311 && versionByte != Version31 {
-		return total, makeError(cp.Type(), "invalid protocol version (%d)", versionByte)
+		return total, fmt.Errorf("%w (%d)", ErrInvalidProtocolVersion, versionByte)
 	}
 
 	// set version
@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -177,7 +178,7 @@ func TestConnectDecodeError5(t *testing.T) {
 	pkt := NewConnect()
 	_, err := pkt.Decode(pktBytes)
 
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInvalidProtocolVersion))
 }
 
 func TestConnectDecodeError6(t *testing.T) {
@@ -1,6 +1,9 @@
 package packet
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // Error represents decoding and encoding errors.
 type Error struct {
@@ -18,3 +21,34 @@ func makeError(typ Type, format string, arguments ...interface{}) *Error {
 func (e *Error) Error() string {
 	return fmt.Sprintf(e.format, e.arguments...)
 }
+
+// ErrInvalidProtocolVersion is matched using errors.Is by the error returned
+// from Connect.Decode if the protocol level is not supported.
+var ErrInvalidProtocolVersion = errors.New("invalid protocol version")
+
+// ErrMalformedPacket is matched using errors.Is by all errors returned from the
+// Decoder for packets that could not be decoded.
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// A MalformedPacketError is returned by the Decoder if a packet could not be
+// decoded. It carries the raw bytes of the packet or just the header if the
+// packet type is invalid.
+type MalformedPacketError struct {
+	Data []byte
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *MalformedPacketError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrMalformedPacket.Error(), e.Err.Error())
+}
+
+// Unwrap returns the underlying decoding error.
+func (e *MalformedPacketError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if the target is ErrMalformedPacket.
+func (e *MalformedPacketError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
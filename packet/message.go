@@ -1,6 +1,9 @@
 package packet
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 // A Message bundles data that is published between brokers and clients.
 type Message struct {
@@ -29,3 +32,8 @@ func (m *Message) String() string {
 func (m Message) Copy() *Message {
 	return &m
 }
+
+// DecodeJSON will unmarshal the JSON encoded payload into the passed value.
+func (m *Message) DecodeJSON(v interface{}) error {
+	return json.Unmarshal(m.Payload, v)
+}
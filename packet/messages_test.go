@@ -29,3 +29,19 @@ func TestMessageCopy(t *testing.T) {
 	msg1.Retain = true
 	assert.False(t, msg2.Retain)
 }
+
+func TestMessageDecodeJSON(t *testing.T) {
+	msg := &Message{
+		Topic:   "w",
+		Payload: []byte(`{"foo":"bar"}`),
+	}
+
+	var v map[string]string
+	err := msg.DecodeJSON(&v)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": "bar"}, v)
+
+	msg.Payload = []byte("m")
+	err = msg.DecodeJSON(&v)
+	assert.Error(t, err)
+}
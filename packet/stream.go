@@ -116,7 +116,7 @@ func (d *Decoder) Read() (Generic, error) {
 		// create packet
 		pkt, err := packetType.New()
 		if err != nil {
-			return nil, err
+			return nil, &MalformedPacketError{Data: append([]byte(nil), header...), Err: err}
 		}
 
 		// reset and eventually grow buffer
@@ -133,13 +133,38 @@ func (d *Decoder) Read() (Generic, error) {
 		// decode buffer
 		_, err = pkt.Decode(buf)
 		if err != nil {
-			return nil, err
+			return nil, &MalformedPacketError{Data: append([]byte(nil), buf...), Err: err}
 		}
 
 		return pkt, nil
 	}
 }
 
+// DecodeStream reads and decodes all packets from the reader until EOF, e.g. to
+// inspect a captured byte stream of a connection. If the stream is truncated
+// or contains an invalid packet, the packets decoded so far are returned
+// together with the error.
+func DecodeStream(reader io.Reader) ([]Generic, error) {
+	// prepare decoder
+	decoder := NewDecoder(reader)
+
+	// prepare list
+	var list []Generic
+
+	for {
+		// read next packet
+		pkt, err := decoder.Read()
+		if err == io.EOF {
+			return list, nil
+		} else if err != nil {
+			return list, err
+		}
+
+		// add packet
+		list = append(list, pkt)
+	}
+}
+
 // A Stream combines an Encoder and Decoder
 type Stream struct {
 	*Decoder
@@ -100,6 +100,9 @@ func TestDecoderInvalidTypeError(t *testing.T) {
 
 	pkt, err := dec.Read()
 	assert.Contains(t, err.Error(), "invalid packet type")
+	assert.True(t, errors.Is(err, ErrMalformedPacket))
+	assert.True(t, errors.Is(err, ErrInvalidPacketType))
+	assert.Equal(t, []byte{0x00, 0x00}, err.(*MalformedPacketError).Data)
 	assert.Nil(t, pkt)
 }
 
@@ -134,10 +137,80 @@ func TestDecoderDecodeError(t *testing.T) {
 	buf.Write([]byte{0x20, 0x02, 0x40, 0x00})
 
 	pkt, err := dec.Read()
-	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrMalformedPacket))
+	assert.Equal(t, []byte{0x20, 0x02, 0x40, 0x00}, err.(*MalformedPacketError).Data)
 	assert.Nil(t, pkt)
 }
 
+func FuzzDecoder(f *testing.F) {
+	for _, pkt := range []Generic{
+		NewConnect(),
+		NewConnack(),
+		&Publish{ID: 1, Message: Message{Topic: "test", Payload: []byte("test"), QOS: 1}},
+		&Subscribe{ID: 1, Subscriptions: []Subscription{{Topic: "test", QOS: 1}}},
+		&Suback{ID: 1, ReturnCodes: []QOS{1}},
+		NewPingreq(),
+	} {
+		buf := make([]byte, pkt.Len())
+		_, err := pkt.Encode(buf)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(buf)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := NewDecoder(bytes.NewReader(data))
+
+		for {
+			pkt, err := dec.Read()
+			if err != nil {
+				if pkt != nil {
+					t.Fatal("packet returned with error")
+				}
+
+				return
+			}
+		}
+	})
+}
+
+func TestDecodeStream(t *testing.T) {
+	publish := NewPublish()
+	publish.ID = 1
+	publish.Message.Topic = "foo"
+	publish.Message.Payload = []byte("bar")
+	publish.Message.QOS = 1
+
+	puback := NewPuback()
+	puback.ID = 1
+
+	pkts := []Generic{NewConnect(), publish, puback, NewDisconnect()}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+
+	for _, pkt := range pkts {
+		err := enc.Write(pkt, false)
+		assert.NoError(t, err)
+	}
+
+	data := buf.Bytes()
+
+	list, err := DecodeStream(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, pkts, list)
+
+	list, err = DecodeStream(bytes.NewReader(data[:len(data)-3]))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, pkts[:2], list)
+
+	list, err = DecodeStream(bytes.NewReader(nil))
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+}
+
 func TestStream(t *testing.T) {
 	in := new(bytes.Buffer)
 	out := new(bytes.Buffer)
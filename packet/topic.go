@@ -0,0 +1,37 @@
+package packet
+
+import "strings"
+
+// ValidTopicName returns whether the supplied topic can be used to publish a
+// message. A topic name must not be empty and must not contain wildcards.
+func ValidTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// ValidTopicFilter returns whether the supplied topic filter can be used to
+// subscribe. A topic filter must not be empty and wildcards must occupy a
+// whole level while the multi-level wildcard may only be the last level.
+func ValidTopicFilter(filter string) bool {
+	// check for zero length
+	if filter == "" {
+		return false
+	}
+
+	// split to levels
+	levels := strings.Split(filter, "/")
+
+	// check all levels
+	for i, l := range levels {
+		// check use of wildcards
+		if strings.ContainsAny(l, "+#") && len(l) > 1 {
+			return false
+		}
+
+		// check if hash is the last level
+		if l == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+
+	return true
+}
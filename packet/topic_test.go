@@ -0,0 +1,54 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTopicName(t *testing.T) {
+	table := map[string]bool{
+		"sport/tennis/player1": true,
+		"sport/tennis":         true,
+		"/finance":             true,
+		"sport//tennis":        true,
+		"/":                    true,
+		"":                     false,
+		"+":                    false,
+		"#":                    false,
+		"sport/+":              false,
+		"sport/tennis/#":       false,
+		"sport+":               false,
+	}
+
+	for topic, valid := range table {
+		assert.Equal(t, valid, ValidTopicName(topic), topic)
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	table := map[string]bool{
+		"sport/tennis/player1/#": true,
+		"sport/#":                true,
+		"#":                      true,
+		"sport/tennis/#":         true,
+		"+":                      true,
+		"+/tennis/#":             true,
+		"sport/+/player1":        true,
+		"/+":                     true,
+		"+/+":                    true,
+		"sport//tennis":          true,
+		"":                       false,
+		"sport/tennis#":          false,
+		"sport/tennis/#/ranking": false,
+		"#/foo":                  false,
+		"sport+":                 false,
+		"sport/+tennis":          false,
+		"++":                     false,
+		"##":                     false,
+	}
+
+	for filter, valid := range table {
+		assert.Equal(t, valid, ValidTopicFilter(filter), filter)
+	}
+}
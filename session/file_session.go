@@ -0,0 +1,329 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrInvalidPacketFile is returned by OpenFileSession if a stored packet file
+// could not be decoded.
+var ErrInvalidPacketFile = errors.New("invalid packet file")
+
+const (
+	packetFileExt = ".pkt"
+	tempFileExt   = ".tmp"
+)
+
+// A FileSession stores packets as individual files in a directory. Each packet
+// is kept in a file named by its packet id below an "incoming" or "outgoing"
+// sub directory. All packets are additionally cached in memory so that lookups
+// do not hit the disk.
+//
+// Packets are first written to a temporary file which is synced and then
+// atomically renamed to its final name, after which the parent directory is
+// synced as well. A SavePacket call therefore only returns after the packet
+// has been durably stored. A crash during a write leaves at most a temporary
+// file behind, which will be removed when the session is opened again.
+type FileSession struct {
+	dir      string
+	counter  *IDCounter
+	incoming *PacketStore
+	outgoing *PacketStore
+	mutex    sync.Mutex
+}
+
+// OpenFileSession opens or creates a FileSession in the specified directory.
+// Previously stored packets are recovered and the id counter continues after
+// the highest recovered outgoing packet id.
+func OpenFileSession(dir string) (*FileSession, error) {
+	// prepare session
+	s := &FileSession{
+		dir: dir,
+	}
+
+	// load incoming packets
+	incoming, err := s.load(Incoming)
+	if err != nil {
+		return nil, err
+	}
+
+	// load outgoing packets
+	outgoing, err := s.load(Outgoing)
+	if err != nil {
+		return nil, err
+	}
+
+	// get highest outgoing id
+	var max packet.ID
+	for _, pkt := range outgoing {
+		if id, ok := packet.GetID(pkt); ok && id > max {
+			max = id
+		}
+	}
+
+	// set stores and counter
+	s.incoming = NewPacketStoreWithPackets(incoming)
+	s.outgoing = NewPacketStoreWithPackets(outgoing)
+	s.counter = NewIDCounterWithNext(max + 1)
+
+	return s, nil
+}
+
+// NextID will return the next id for outgoing packets. Ids that are still
+// used by packets in the outgoing store are skipped.
+func (s *FileSession) NextID() packet.ID {
+	return nextFreeID(s.counter, s.outgoing)
+}
+
+// SavePacket will store a packet in the session. An eventual existing
+// packet with the same id gets quietly overwritten.
+func (s *FileSession) SavePacket(dir Direction, pkt packet.Generic) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get id
+	id, ok := packet.GetID(pkt)
+	if !ok {
+		return fmt.Errorf("packet %s has no id", pkt.Type())
+	}
+
+	// encode packet
+	buf := make([]byte, pkt.Len())
+	_, err := pkt.Encode(buf)
+	if err != nil {
+		return err
+	}
+
+	// write file
+	err = s.write(dir, id, buf)
+	if err != nil {
+		return err
+	}
+
+	// cache packet
+	s.storeForDirection(dir).Save(pkt)
+
+	return nil
+}
+
+// LookupPacket will retrieve a packet from the session using a packet id.
+func (s *FileSession) LookupPacket(dir Direction, id packet.ID) (packet.Generic, error) {
+	return s.storeForDirection(dir).Lookup(id), nil
+}
+
+// DeletePacket will remove a packet from the session. The method must not
+// return an error if no packet with the specified id does exists.
+func (s *FileSession) DeletePacket(dir Direction, id packet.ID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// remove file
+	err := os.Remove(s.path(dir, id) + packetFileExt)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// remove packet from cache
+	s.storeForDirection(dir).Delete(id)
+
+	return nil
+}
+
+// AllPackets will return all packets currently saved in the session.
+func (s *FileSession) AllPackets(dir Direction) ([]packet.Generic, error) {
+	return s.storeForDirection(dir).All(), nil
+}
+
+// Size will return the encoded size in bytes of all packets currently saved in
+// the session.
+func (s *FileSession) Size(dir Direction) int {
+	return s.storeForDirection(dir).Size()
+}
+
+// Reset will completely reset the session.
+func (s *FileSession) Reset() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// remove directories
+	for _, dir := range []Direction{Incoming, Outgoing} {
+		err := os.RemoveAll(s.directory(dir))
+		if err != nil {
+			return err
+		}
+	}
+
+	// reset counter and stores
+	s.counter.Reset()
+	s.incoming.Reset()
+	s.outgoing.Reset()
+
+	return nil
+}
+
+func (s *FileSession) load(dir Direction) ([]packet.Generic, error) {
+	// ensure directory
+	err := os.MkdirAll(s.directory(dir), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// read directory
+	entries, err := ioutil.ReadDir(s.directory(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare list
+	var list []packet.Generic
+
+	for _, entry := range entries {
+		name := filepath.Join(s.directory(dir), entry.Name())
+
+		// remove left over temporary files from interrupted writes
+		if strings.HasSuffix(entry.Name(), tempFileExt) {
+			err = os.Remove(name)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		// skip unknown files
+		if !strings.HasSuffix(entry.Name(), packetFileExt) {
+			continue
+		}
+
+		// read file
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// decode packet
+		pkt, err := decodePacket(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPacketFile, name, err)
+		}
+
+		// add packet
+		list = append(list, pkt)
+	}
+
+	return list, nil
+}
+
+func (s *FileSession) write(dir Direction, id packet.ID, buf []byte) error {
+	// ensure directory
+	err := os.MkdirAll(s.directory(dir), 0700)
+	if err != nil {
+		return err
+	}
+
+	// get paths
+	tmp := s.path(dir, id) + tempFileExt
+	final := s.path(dir, id) + packetFileExt
+
+	// create temporary file
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// write and sync data
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	// close file
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+
+	// remove temporary file on error
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// move file into place
+	err = os.Rename(tmp, final)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(s.directory(dir))
+}
+
+func (s *FileSession) directory(dir Direction) string {
+	if dir == Incoming {
+		return filepath.Join(s.dir, "incoming")
+	} else if dir == Outgoing {
+		return filepath.Join(s.dir, "outgoing")
+	}
+
+	panic("unknown direction")
+}
+
+func (s *FileSession) path(dir Direction, id packet.ID) string {
+	return filepath.Join(s.directory(dir), strconv.Itoa(int(id)))
+}
+
+func (s *FileSession) storeForDirection(dir Direction) *PacketStore {
+	if dir == Incoming {
+		return s.incoming
+	} else if dir == Outgoing {
+		return s.outgoing
+	}
+
+	panic("unknown direction")
+}
+
+func decodePacket(buf []byte) (packet.Generic, error) {
+	// detect packet
+	l, t := packet.DetectPacket(buf)
+	if l == 0 || l != len(buf) {
+		return nil, errors.New("incomplete packet")
+	}
+
+	// create packet
+	pkt, err := t.New()
+	if err != nil {
+		return nil, err
+	}
+
+	// decode packet
+	_, err = pkt.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+func syncDir(dir string) error {
+	// open directory
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	// sync directory
+	err = file.Sync()
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-session")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	session, err := OpenFileSession(dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, packet.ID(1), session.NextID())
+	assert.Equal(t, packet.ID(2), session.NextID())
+
+	publish := packet.NewPublish()
+	publish.ID = 2
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+	publish.Message.QOS = 1
+
+	pubrel := packet.NewPubrel()
+	pubrel.ID = 7
+
+	err = session.SavePacket(Outgoing, publish)
+	assert.NoError(t, err)
+
+	err = session.SavePacket(Incoming, pubrel)
+	assert.NoError(t, err)
+
+	pkt, err := session.LookupPacket(Outgoing, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, publish, pkt)
+
+	// simulate interrupted write
+	err = ioutil.WriteFile(filepath.Join(dir, "outgoing", "3.tmp"), []byte{0x30}, 0600)
+	assert.NoError(t, err)
+
+	session, err = OpenFileSession(dir)
+	assert.NoError(t, err)
+
+	assert.Equal(t, packet.ID(3), session.NextID())
+
+	list, err := session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, []packet.Generic{publish}, list)
+
+	list, err = session.AllPackets(Incoming)
+	assert.NoError(t, err)
+	assert.Equal(t, []packet.Generic{pubrel}, list)
+
+	_, err = os.Stat(filepath.Join(dir, "outgoing", "3.tmp"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = session.DeletePacket(Outgoing, 2)
+	assert.NoError(t, err)
+
+	err = session.DeletePacket(Outgoing, 2)
+	assert.NoError(t, err)
+
+	err = session.Reset()
+	assert.NoError(t, err)
+
+	assert.Equal(t, packet.ID(1), session.NextID())
+
+	session, err = OpenFileSession(dir)
+	assert.NoError(t, err)
+
+	list, err = session.AllPackets(Incoming)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestFileSessionInvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-session")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "incoming"), 0700)
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "incoming", "1.pkt"), []byte{0x30, 0x05}, 0600)
+	assert.NoError(t, err)
+
+	_, err = OpenFileSession(dir)
+	assert.Error(t, err)
+}
@@ -3,6 +3,8 @@
 package session
 
 import (
+	"math"
+
 	"github.com/256dpi/gomqtt/packet"
 )
 
@@ -33,9 +35,10 @@ func NewMemorySession() *MemorySession {
 	}
 }
 
-// NextID will return the next id for outgoing packets.
+// NextID will return the next id for outgoing packets. Ids that are still
+// used by packets in the outgoing store are skipped.
 func (s *MemorySession) NextID() packet.ID {
-	return s.Counter.NextID()
+	return nextFreeID(s.Counter, s.Outgoing)
 }
 
 // SavePacket will store a packet in the session. An eventual existing
@@ -62,6 +65,12 @@ func (s *MemorySession) AllPackets(dir Direction) ([]packet.Generic, error) {
 	return s.storeForDirection(dir).All(), nil
 }
 
+// Size will return the encoded size in bytes of all packets currently saved in
+// the session.
+func (s *MemorySession) Size(dir Direction) int {
+	return s.storeForDirection(dir).Size()
+}
+
 // Reset will completely reset the session.
 func (s *MemorySession) Reset() error {
 	// reset counter and stores
@@ -72,6 +81,22 @@ func (s *MemorySession) Reset() error {
 	return nil
 }
 
+// returns the next id from the counter that is not used in the store or the
+// next id if all ids are in use
+func nextFreeID(counter *IDCounter, store *PacketStore) packet.ID {
+	id := counter.NextID()
+
+	for i := 0; i < math.MaxUint16-1; i++ {
+		if store.Lookup(id) == nil {
+			break
+		}
+
+		id = counter.NextID()
+	}
+
+	return id
+}
+
 func (s *MemorySession) storeForDirection(dir Direction) *PacketStore {
 	if dir == Incoming {
 		return s.Incoming
@@ -28,6 +28,31 @@ func TestMemorySessionNextID(t *testing.T) {
 	assert.Equal(t, packet.ID(1), session.NextID())
 }
 
+func TestMemorySessionNextIDSkipsUsed(t *testing.T) {
+	session := NewMemorySession()
+	session.Counter = NewIDCounterWithNext(math.MaxUint16)
+
+	for _, id := range []packet.ID{1, 2, 4} {
+		publish := packet.NewPublish()
+		publish.ID = id
+
+		err := session.SavePacket(Outgoing, publish)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, packet.ID(math.MaxUint16), session.NextID())
+	assert.Equal(t, packet.ID(3), session.NextID())
+	assert.Equal(t, packet.ID(5), session.NextID())
+
+	err := session.DeletePacket(Outgoing, 1)
+	assert.NoError(t, err)
+
+	session.Counter.Reset()
+
+	assert.Equal(t, packet.ID(1), session.NextID())
+	assert.Equal(t, packet.ID(3), session.NextID())
+}
+
 func TestMemorySessionPacketStore(t *testing.T) {
 	session := NewMemorySession()
 
@@ -9,6 +9,7 @@ import (
 // PacketStore is a goroutine safe packet store.
 type PacketStore struct {
 	packets map[packet.ID]packet.Generic
+	size    int
 	mutex   sync.RWMutex
 }
 
@@ -42,7 +43,12 @@ func (s *PacketStore) Save(pkt packet.Generic) {
 
 	id, ok := packet.GetID(pkt)
 	if ok {
+		if old, ok := s.packets[id]; ok {
+			s.size -= old.Len()
+		}
+
 		s.packets[id] = pkt
+		s.size += pkt.Len()
 	}
 }
 
@@ -59,7 +65,10 @@ func (s *PacketStore) Delete(id packet.ID) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	delete(s.packets, id)
+	if pkt, ok := s.packets[id]; ok {
+		s.size -= pkt.Len()
+		delete(s.packets, id)
+	}
 }
 
 // All will return all packets currently saved in the store.
@@ -76,10 +85,28 @@ func (s *PacketStore) All() []packet.Generic {
 	return all
 }
 
+// Len will return the number of packets currently saved in the store.
+func (s *PacketStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.packets)
+}
+
+// Size will return the encoded size in bytes of all packets currently saved in
+// the store.
+func (s *PacketStore) Size() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.size
+}
+
 // Reset will reset the store.
 func (s *PacketStore) Reset() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	s.packets = make(map[packet.ID]packet.Generic)
+	s.size = 0
 }
@@ -36,3 +36,34 @@ func TestPacketStore(t *testing.T) {
 	store = NewPacketStoreWithPackets([]packet.Generic{&packet.Subscribe{ID: 7}})
 	assert.Equal(t, []packet.Generic{&packet.Subscribe{ID: 7}}, store.All())
 }
+
+func TestPacketStoreSize(t *testing.T) {
+	store := NewPacketStore()
+	assert.Equal(t, 0, store.Len())
+	assert.Equal(t, 0, store.Size())
+
+	publish := packet.NewPublish()
+	publish.ID = 1
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+	publish.Message.QOS = 1
+
+	store.Save(publish)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, publish.Len(), store.Size())
+
+	pubrel := packet.NewPubrel()
+	pubrel.ID = 1
+
+	store.Save(pubrel)
+	assert.Equal(t, 1, store.Len())
+	assert.Equal(t, pubrel.Len(), store.Size())
+
+	store.Delete(1)
+	assert.Equal(t, 0, store.Len())
+	assert.Equal(t, 0, store.Size())
+
+	store.Save(publish)
+	store.Reset()
+	assert.Equal(t, 0, store.Size())
+}
@@ -510,7 +510,7 @@ func CleanWillTest(t *testing.T, config *Config, topic string) {
 // KeepAliveTest tests the broker for proper keep alive support.
 func KeepAliveTest(t *testing.T, config *Config) {
 	opts := client.NewConfig(config.URL)
-	opts.KeepAlive = "2s" // mosquitto fails with a keep alive of 1s
+	opts.KeepAlive = 2 * time.Second // mosquitto fails with a keep alive of 1s
 
 	c := client.New()
 
@@ -0,0 +1,135 @@
+package spec
+
+import (
+	"testing"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/session"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// SessionTest tests a session implementation for conforming to the contract of
+// client.Session. The open function should return a new and empty session.
+func SessionTest(t *testing.T, open func() client.Session) {
+	t.Run("NextID", func(t *testing.T) {
+		sess := open()
+
+		id1 := sess.NextID()
+		id2 := sess.NextID()
+		assert.NotEqual(t, packet.ID(0), id1)
+		assert.NotEqual(t, packet.ID(0), id2)
+		assert.NotEqual(t, id1, id2)
+	})
+
+	t.Run("SaveLookupDelete", func(t *testing.T) {
+		sess := open()
+
+		for _, dir := range []session.Direction{session.Incoming, session.Outgoing} {
+			pkt, err := sess.LookupPacket(dir, 1)
+			assert.NoError(t, err)
+			assert.Nil(t, pkt)
+
+			publish := packet.NewPublish()
+			publish.ID = 1
+			publish.Message.Topic = "test"
+			publish.Message.Payload = testPayload
+			publish.Message.QOS = 1
+
+			err = sess.SavePacket(dir, publish)
+			assert.NoError(t, err)
+
+			pkt, err = sess.LookupPacket(dir, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, publish, pkt)
+
+			err = sess.DeletePacket(dir, 1)
+			assert.NoError(t, err)
+
+			pkt, err = sess.LookupPacket(dir, 1)
+			assert.NoError(t, err)
+			assert.Nil(t, pkt)
+
+			err = sess.DeletePacket(dir, 1)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		sess := open()
+
+		publish := packet.NewPublish()
+		publish.ID = 1
+		publish.Message.Topic = "test"
+		publish.Message.QOS = 2
+
+		pubrel := packet.NewPubrel()
+		pubrel.ID = 1
+
+		err := sess.SavePacket(session.Outgoing, publish)
+		assert.NoError(t, err)
+
+		err = sess.SavePacket(session.Outgoing, pubrel)
+		assert.NoError(t, err)
+
+		pkt, err := sess.LookupPacket(session.Outgoing, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, pubrel, pkt)
+
+		list, err := sess.AllPackets(session.Outgoing)
+		assert.NoError(t, err)
+		assert.Equal(t, []packet.Generic{pubrel}, list)
+	})
+
+	t.Run("Directions", func(t *testing.T) {
+		sess := open()
+
+		pubrec := packet.NewPubrec()
+		pubrec.ID = 1
+
+		subscribe := packet.NewSubscribe()
+		subscribe.ID = 2
+		subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+
+		err := sess.SavePacket(session.Incoming, pubrec)
+		assert.NoError(t, err)
+
+		err = sess.SavePacket(session.Outgoing, subscribe)
+		assert.NoError(t, err)
+
+		list, err := sess.AllPackets(session.Incoming)
+		assert.NoError(t, err)
+		assert.Equal(t, []packet.Generic{pubrec}, list)
+
+		list, err = sess.AllPackets(session.Outgoing)
+		assert.NoError(t, err)
+		assert.Equal(t, []packet.Generic{subscribe}, list)
+
+		pkt, err := sess.LookupPacket(session.Outgoing, 1)
+		assert.NoError(t, err)
+		assert.Nil(t, pkt)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		sess := open()
+
+		pubrel := packet.NewPubrel()
+		pubrel.ID = sess.NextID()
+
+		err := sess.SavePacket(session.Outgoing, pubrel)
+		assert.NoError(t, err)
+
+		err = sess.SavePacket(session.Incoming, pubrel)
+		assert.NoError(t, err)
+
+		err = sess.Reset()
+		assert.NoError(t, err)
+
+		for _, dir := range []session.Direction{session.Incoming, session.Outgoing} {
+			list, err := sess.AllPackets(dir)
+			assert.NoError(t, err)
+			assert.Empty(t, list)
+		}
+	})
+}
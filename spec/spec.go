@@ -1,4 +1,5 @@
-// Package spec implements a reusable specification test for MQTT brokers.
+// Package spec implements a reusable specification test for MQTT brokers and
+// a conformance test for client sessions.
 package spec
 
 import (
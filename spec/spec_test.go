@@ -1,8 +1,17 @@
 package spec
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/session"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSpec(t *testing.T) {
@@ -17,3 +26,23 @@ func TestSpec(t *testing.T) {
 
 	Run(t, config)
 }
+
+func TestMemorySession(t *testing.T) {
+	SessionTest(t, func() client.Session {
+		return session.NewMemorySession()
+	})
+}
+
+func TestFileSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-spec")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var i int
+	SessionTest(t, func() client.Session {
+		i++
+		sess, err := session.OpenFileSession(filepath.Join(dir, strconv.Itoa(i)))
+		assert.NoError(t, err)
+		return sess
+	})
+}
@@ -231,6 +231,9 @@ func (t *Tree) clear(value interface{}, node *node) bool {
 //
 // Note: In contrast to Search, Match does not respect wildcards in the query but
 // in the stored tree.
+//
+// Note: As required by the specification, wildcards at the first level of a
+// subscription will not match topics that begin with a "$" character.
 func (t *Tree) Match(topic string) []interface{} {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
@@ -242,8 +245,11 @@ func (t *Tree) Match(topic string) []interface{} {
 }
 
 func (t *Tree) match(result []interface{}, i int, segments []string, node *node) []interface{} {
+	// wildcards at the root level must not match topics starting with "$"
+	wildcards := node != t.root || !strings.HasPrefix(segments[0], "$")
+
 	// add all values to the result set that match multiple levels
-	if child, ok := node.children[t.WildcardSome]; ok {
+	if child, ok := node.children[t.WildcardSome]; ok && wildcards {
 		result = append(result, child.values...)
 	}
 
@@ -253,7 +259,7 @@ func (t *Tree) match(result []interface{}, i int, segments []string, node *node)
 	}
 
 	// advance children that match a single level
-	if child, ok := node.children[t.WildcardOne]; ok {
+	if child, ok := node.children[t.WildcardOne]; ok && wildcards {
 		result = t.match(result, i+1, segments, child)
 	}
 
@@ -285,6 +291,9 @@ func (t *Tree) MatchFirst(topic string) interface{} {
 //
 // Note: In contrast to Match, Search respects wildcards in the query but not in
 // the stored tree.
+//
+// Note: As with Match, wildcards at the first level of the query will not match
+// stored topics that begin with a "$" character.
 func (t *Tree) Search(topic string) []interface{} {
 	t.mutex.RLock()
 	defer t.mutex.RUnlock()
@@ -308,7 +317,11 @@ func (t *Tree) search(result []interface{}, i int, segments []string, node *node
 	if segment == t.WildcardSome {
 		result = append(result, node.values...)
 
-		for _, child := range node.children {
+		for key, child := range node.children {
+			if t.skipSystem(node, key) {
+				continue
+			}
+
 			result = t.search(result, i, segments, child)
 		}
 	}
@@ -317,7 +330,11 @@ func (t *Tree) search(result []interface{}, i int, segments []string, node *node
 	if segment == t.WildcardOne {
 		result = append(result, node.values...)
 
-		for _, child := range node.children {
+		for key, child := range node.children {
+			if t.skipSystem(node, key) {
+				continue
+			}
+
 			result = t.search(result, i+1, segments, child)
 		}
 	}
@@ -332,6 +349,11 @@ func (t *Tree) search(result []interface{}, i int, segments []string, node *node
 	return result
 }
 
+// wildcards at the root level must not match topics starting with "$"
+func (t *Tree) skipSystem(node *node, key string) bool {
+	return node == t.root && strings.HasPrefix(key, "$")
+}
+
 // SearchFirst will run Search and return the first value or nil.
 func (t *Tree) SearchFirst(topic string) interface{} {
 	values := t.Search(topic)
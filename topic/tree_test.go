@@ -155,6 +155,55 @@ func TestTreeMatchNoDuplicates(t *testing.T) {
 	assert.Equal(t, 1, len(tree.Match("foo/bar")))
 }
 
+func TestTreeMatchSpec(t *testing.T) {
+	table := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"#", "sport/tennis", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"$SYS/+", "$SYS/broker", true},
+		{"foo/#", "foo/$bar", true},
+	}
+
+	for _, entry := range table {
+		tree := NewTree()
+		tree.Add(entry.filter, 1)
+
+		if entry.match {
+			assert.Equal(t, []interface{}{1}, tree.Match(entry.topic), entry.filter+" "+entry.topic)
+		} else {
+			assert.Empty(t, tree.Match(entry.topic), entry.filter+" "+entry.topic)
+		}
+	}
+}
+
+func TestTreeSearchSystem(t *testing.T) {
+	tree := NewTree()
+
+	tree.Add("$SYS/broker", 1)
+	tree.Add("foo/$bar", 2)
+
+	assert.Equal(t, []interface{}{2}, tree.Search("#"))
+	assert.Empty(t, tree.Search("+/broker"))
+	assert.Equal(t, []interface{}{1}, tree.Search("$SYS/#"))
+	assert.Equal(t, []interface{}{2}, tree.Search("foo/#"))
+}
+
 func TestTreeMatchFirst(t *testing.T) {
 	tree := NewTree()
 
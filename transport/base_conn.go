@@ -26,6 +26,7 @@ type BaseConn struct {
 	rMutex sync.Mutex
 
 	readTimeout time.Duration
+	keepOpen    func(error) bool
 }
 
 // NewBaseConn creates a new BaseConn using the specified Carrier.
@@ -58,6 +59,24 @@ func (c *BaseConn) Send(pkt packet.Generic, async bool) error {
 	return nil
 }
 
+// Flush will write all buffered packets to the underlying connection. Any
+// network errors caught while flushing asynchronously are returned as well.
+func (c *BaseConn) Flush() error {
+	c.sMutex.Lock()
+	defer c.sMutex.Unlock()
+
+	// flush buffer
+	err := c.stream.Flush()
+	if err != nil {
+		// ensure connection gets closed
+		c.carrier.Close()
+
+		return err
+	}
+
+	return nil
+}
+
 // Receive will read from the underlying connection and return a fully read
 // packet. It will return an Error if there was an error while decoding or
 // reading from the underlying connection.
@@ -70,8 +89,10 @@ func (c *BaseConn) Receive() (packet.Generic, error) {
 	// read next packet
 	pkt, err := c.stream.Read()
 	if err != nil {
-		// ensure connection gets closed
-		c.carrier.Close()
+		// ensure connection gets closed unless it should be kept open
+		if c.keepOpen == nil || !c.keepOpen(err) {
+			c.carrier.Close()
+		}
 
 		return nil, err
 	}
@@ -105,6 +126,12 @@ func (c *BaseConn) Close() error {
 	return nil
 }
 
+// SetKeepOpen sets a function that is called with errors returned by Receive.
+// The connection is not closed if the function returns true.
+func (c *BaseConn) SetKeepOpen(fn func(error) bool) {
+	c.keepOpen = fn
+}
+
 // SetReadLimit sets the maximum size of a packet that can be received.
 // If the limit is greater than zero, Receive will close the connection and
 // return an Error if receiving the next packet will exceed the limit.
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -46,3 +47,27 @@ type Conn interface {
 	// RemoteAddr will return the underlying connection's remote net address.
 	RemoteAddr() net.Addr
 }
+
+// A Flusher is a Conn that allows flushing its internal buffer on demand.
+type Flusher interface {
+	// Flush will write all buffered packets to the underlying connection. Any
+	// network errors caught while flushing asynchronously are returned as well.
+	Flush() error
+}
+
+// A KeepOpener is a Conn that can keep the underlying connection open if
+// Receive returns an error, e.g. to respond to a rejected packet before closing
+// the connection.
+type KeepOpener interface {
+	// SetKeepOpen sets a function that is called with errors returned by
+	// Receive. The connection is not closed if the function returns true.
+	SetKeepOpen(func(error) bool)
+}
+
+// A TLSConn is a Conn that may have been established using TLS.
+type TLSConn interface {
+	// ConnectionState returns the state of the TLS connection. False is
+	// returned if the connection does not use TLS. The state is only complete
+	// once the handshake has been performed with the first read or write.
+	ConnectionState() (tls.ConnectionState, bool)
+}
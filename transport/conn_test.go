@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"errors"
 	"io"
 	"testing"
 	"time"
@@ -89,6 +90,42 @@ func abstractConnDecodeErrorTest(t *testing.T, protocol string) {
 	safeReceive(done)
 }
 
+func abstractConnKeepOpenTest(t *testing.T, protocol string) {
+	conn2, done := connectionPair(protocol, func(conn1 Conn) {
+		buf := []byte{0x00, 0x00} // < too small
+
+		if netConn, ok := conn1.(*NetConn); ok {
+			netConn.conn.Write(buf)
+		} else if webSocketConn, ok := conn1.(*WebSocketConn); ok {
+			webSocketConn.conn.WriteMessage(websocket.BinaryMessage, buf)
+		}
+
+		pkt, err := conn1.Receive()
+		assert.Equal(t, packet.NewConnect(), pkt)
+		assert.NoError(t, err)
+
+		pkt, err = conn1.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	conn2.(KeepOpener).SetKeepOpen(func(err error) bool {
+		return errors.Is(err, packet.ErrMalformedPacket)
+	})
+
+	pkt, err := conn2.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+
+	err = conn2.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	err = conn2.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
 func abstractConnSendAfterCloseTest(t *testing.T, protocol string) {
 	conn2, done := connectionPair(protocol, func(conn1 Conn) {
 		err := conn1.Close()
@@ -254,6 +291,36 @@ func abstractConnAsyncSendTest(t *testing.T, protocol string) {
 	safeReceive(done)
 }
 
+func abstractConnFlushTest(t *testing.T, protocol string) {
+	conn2, done := connectionPair(protocol, func(conn1 Conn) {
+		pkt, err := conn1.Receive()
+		assert.Equal(t, pkt.Type(), packet.CONNECT)
+		assert.NoError(t, err)
+
+		err = conn1.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		pkt, err = conn1.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	err := conn2.Send(packet.NewConnect(), true)
+	assert.NoError(t, err)
+
+	err = conn2.(Flusher).Flush()
+	assert.NoError(t, err)
+
+	pkt, err := conn2.Receive()
+	assert.Equal(t, pkt.Type(), packet.CONNACK)
+	assert.NoError(t, err)
+
+	err = conn2.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
 func abstractConnSendAfterAsyncSendTest(t *testing.T, protocol string) {
 	conn2, done := connectionPair(protocol, func(conn1 Conn) {
 		pkt, err := conn1.Receive()
@@ -348,3 +415,31 @@ func abstractConnBigAsyncSendAfterCloseTest(t *testing.T, protocol string) {
 
 	safeReceive(done)
 }
+
+func abstractConnConnectionStateTest(t *testing.T, protocol string, secure bool) {
+	conn2, done := connectionPair(protocol, func(conn1 Conn) {
+		pkt, err := conn1.Receive()
+		assert.Equal(t, pkt.Type(), packet.CONNECT)
+		assert.NoError(t, err)
+
+		state, ok := conn1.(TLSConn).ConnectionState()
+		assert.Equal(t, secure, ok)
+		assert.Equal(t, secure, state.HandshakeComplete)
+
+		err = conn1.Close()
+		assert.NoError(t, err)
+	})
+
+	err := conn2.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	state, ok := conn2.(TLSConn).ConnectionState()
+	assert.Equal(t, secure, ok)
+	assert.Equal(t, secure, state.HandshakeComplete)
+
+	pkt, err := conn2.Receive()
+	assert.Nil(t, pkt)
+	assert.Equal(t, io.EOF, err)
+
+	safeReceive(done)
+}
@@ -1,11 +1,16 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -15,6 +20,11 @@ type Dialer struct {
 	TLSConfig     *tls.Config
 	RequestHeader http.Header
 
+	// WebSocketCompression enables the negotiation of the permessage-deflate
+	// extension for WebSocket connections. Messages are only compressed if the
+	// server supports the extension as well.
+	WebSocketCompression bool
+
 	DefaultTCPPort string
 	DefaultTLSPort string
 	DefaultWSPort  string
@@ -48,8 +58,20 @@ func Dial(urlString string) (Conn, error) {
 	return sharedDialer.Dial(urlString)
 }
 
+// DialContext is a shorthand function.
+func DialContext(ctx context.Context, urlString string) (Conn, error) {
+	return sharedDialer.DialContext(ctx, urlString)
+}
+
 // Dial initiates a connection based in information extracted from an URL.
 func (d *Dialer) Dial(urlString string) (Conn, error) {
+	return d.DialContext(context.Background(), urlString)
+}
+
+// DialContext initiates a connection based in information extracted from an
+// URL. The dial and any following handshake is aborted if the context is
+// cancelled before the connection has been established.
+func (d *Dialer) DialContext(ctx context.Context, urlString string) (Conn, error) {
 	urlParts, err := url.ParseRequestURI(urlString)
 	if err != nil {
 		return nil, err
@@ -67,7 +89,7 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 			port = d.DefaultTCPPort
 		}
 
-		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		conn, err := d.netDial(ctx, "tcp", net.JoinHostPort(host, port))
 		if err != nil {
 			return nil, err
 		}
@@ -78,12 +100,36 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 			port = d.DefaultTLSPort
 		}
 
-		conn, err := tls.Dial("tcp", net.JoinHostPort(host, port), d.TLSConfig)
+		conn, err := d.netDial(ctx, "tcp", net.JoinHostPort(host, port))
 		if err != nil {
 			return nil, err
 		}
 
-		return NewNetConn(conn), nil
+		// derive server name from host if missing
+		config := d.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = host
+		}
+
+		// perform handshake
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+
+			// prefer context error
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			return nil, &HandshakeError{Err: err}
+		}
+
+		return NewNetConn(tlsConn), nil
 	case "ws":
 		if port == "" {
 			port = d.DefaultWSPort
@@ -91,7 +137,7 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 
 		wsURL := fmt.Sprintf("ws://%s:%s%s", host, port, urlParts.Path)
 
-		conn, _, err := d.webSocketDialer.Dial(wsURL, d.RequestHeader)
+		conn, err := d.webSocketDial(ctx, wsURL)
 		if err != nil {
 			return nil, err
 		}
@@ -104,14 +150,104 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 
 		wsURL := fmt.Sprintf("wss://%s:%s%s", host, port, urlParts.Path)
 
-		d.webSocketDialer.TLSClientConfig = d.TLSConfig
-		conn, _, err := d.webSocketDialer.Dial(wsURL, d.RequestHeader)
+		conn, err := d.webSocketDial(ctx, wsURL)
 		if err != nil {
 			return nil, err
 		}
 
 		return NewWebSocketConn(conn), nil
+	case "unix":
+		conn, err := d.netDial(ctx, "unix", urlParts.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewNetConn(conn), nil
 	}
 
 	return nil, ErrUnsupportedProtocol
 }
+
+func (d *Dialer) netDial(ctx context.Context, network, address string) (net.Conn, error) {
+	var netDialer net.Dialer
+	return netDialer.DialContext(ctx, network, address)
+}
+
+func (d *Dialer) webSocketDial(ctx context.Context, wsURL string) (*websocket.Conn, error) {
+	// prepare channel
+	dialed := make(chan net.Conn, 1)
+
+	// copy dialer to use a context aware net dialer
+	webSocketDialer := *d.webSocketDialer
+	webSocketDialer.TLSClientConfig = d.TLSConfig
+	webSocketDialer.EnableCompression = d.WebSocketCompression
+	webSocketDialer.NetDial = func(network, address string) (net.Conn, error) {
+		conn, err := d.netDial(ctx, network, address)
+		if err == nil {
+			dialed <- conn
+		}
+
+		return conn, err
+	}
+
+	// prepare channels
+	abort := make(chan struct{})
+	stopped := make(chan struct{})
+
+	// abort the handshake when the context is cancelled
+	go func() {
+		defer close(stopped)
+
+		select {
+		case conn := <-dialed:
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now())
+			case <-abort:
+			}
+		case <-abort:
+		}
+	}()
+
+	// dial connection and perform handshake
+	conn, _, err := webSocketDialer.Dial(wsURL, d.RequestHeader)
+
+	// stop watcher
+	close(abort)
+	<-stopped
+
+	// prefer context error
+	if ctx.Err() != nil {
+		if conn != nil {
+			conn.Close()
+		}
+
+		return nil, ctx.Err()
+	} else if err != nil {
+		// the handshake is performed by the websocket dialer
+		if isHandshakeError(err) {
+			return nil, &HandshakeError{Err: err}
+		}
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func isHandshakeError(err error) bool {
+	// check certificate and record errors
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) {
+		return true
+	}
+
+	// check alerts and other protocol errors
+	return strings.HasPrefix(err.Error(), "tls: ")
+}
@@ -1,8 +1,12 @@
 package transport
 
 import (
+	"context"
+	"errors"
 	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -73,6 +77,35 @@ func TestDialerWSSError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func abstractHandshakeErrorTest(t *testing.T, protocol string) {
+	server, err := testLauncher.Launch(protocol + "://localhost:0")
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := NewDialer().Dial(getURL(server, protocol))
+	assert.Nil(t, conn)
+
+	var handshakeErr *HandshakeError
+	assert.True(t, errors.As(err, &handshakeErr))
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	abstractHandshakeErrorTest(t, "tls")
+}
+
+func TestWSSHandshakeError(t *testing.T) {
+	abstractHandshakeErrorTest(t, "wss")
+}
+
 func abstractDefaultPortTest(t *testing.T, protocol string) {
 	server, err := testLauncher.Launch(protocol + "://localhost:0")
 	require.NoError(t, err)
@@ -124,3 +157,47 @@ func TestWSDefaultPort(t *testing.T) {
 func TestWSSDefaultPort(t *testing.T) {
 	abstractDefaultPortTest(t, "wss")
 }
+
+func abstractDialContextTest(t *testing.T, protocol string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	wait := make(chan struct{})
+
+	go func() {
+		// accept but never complete the handshake
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+
+		<-wait
+
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	dialer := NewDialer()
+	dialer.TLSConfig = clientTLSConfig
+
+	conn, err := dialer.DialContext(ctx, protocol+"://"+listener.Addr().String())
+	assert.Nil(t, conn)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(wait)
+
+	err = listener.Close()
+	assert.NoError(t, err)
+}
+
+func TestTLSDialContext(t *testing.T) {
+	abstractDialContextTest(t, "tls")
+}
+
+func TestWSDialContext(t *testing.T) {
+	abstractDialContextTest(t, "ws")
+}
+
+func TestWSSDialContext(t *testing.T) {
+	abstractDialContextTest(t, "wss")
+}
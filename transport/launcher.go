@@ -8,6 +8,11 @@ import (
 // The Launcher helps with launching a server and accepting connections.
 type Launcher struct {
 	TLSConfig *tls.Config
+
+	// WebSocketCompression enables the negotiation of the permessage-deflate
+	// extension on launched "ws" and "wss" servers, see
+	// WebSocketServer.SetCompression.
+	WebSocketCompression bool
 }
 
 // NewLauncher returns a new Launcher.
@@ -39,9 +44,23 @@ func (l *Launcher) Launch(urlString string) (Server, error) {
 	case "tls", "mqtts":
 		return CreateSecureNetServer(urlParts.Host, l.TLSConfig)
 	case "ws":
-		return CreateWebSocketServer(urlParts.Host)
+		server, err := CreateWebSocketServer(urlParts.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		server.SetCompression(l.WebSocketCompression)
+		return server, nil
 	case "wss":
-		return CreateSecureWebSocketServer(urlParts.Host, l.TLSConfig)
+		server, err := CreateSecureWebSocketServer(urlParts.Host, l.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		server.SetCompression(l.WebSocketCompression)
+		return server, nil
+	case "unix":
+		return CreateUnixServer(urlParts.Path)
 	}
 
 	return nil, ErrUnsupportedProtocol
@@ -3,6 +3,7 @@ package transport
 import (
 	"testing"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -26,3 +27,41 @@ func TestLauncherUnsupportedProtocol(t *testing.T) {
 	assert.Nil(t, conn)
 	assert.Equal(t, ErrUnsupportedProtocol, err)
 }
+
+func TestLauncherWebSocketCompression(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		launcher := NewLauncher()
+		launcher.WebSocketCompression = enabled
+
+		server, err := launcher.Launch("ws://localhost:0")
+		require.NoError(t, err)
+
+		go func() {
+			conn, err := server.Accept()
+			if err == nil {
+				_ = conn.Close()
+			}
+		}()
+
+		dialer := &websocket.Dialer{
+			Subprotocols:      []string{"mqtt"},
+			EnableCompression: true,
+		}
+
+		conn, res, err := dialer.Dial(getURL(server, "ws"), nil)
+		require.NoError(t, err)
+
+		extensions := res.Header.Get("Sec-WebSocket-Extensions")
+		if enabled {
+			assert.Contains(t, extensions, "permessage-deflate")
+		} else {
+			assert.NotContains(t, extensions, "permessage-deflate")
+		}
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		err = server.Close()
+		assert.NoError(t, err)
+	}
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"crypto/tls"
 	"net"
 )
 
@@ -19,6 +20,15 @@ func NewNetConn(conn net.Conn) *NetConn {
 	}
 }
 
+// Pipe returns two connected in-memory connections. Packets sent on one end
+// are received on the other end and closing one end closes the other end as
+// well. It is useful to wire clients and brokers together in tests without
+// opening sockets.
+func Pipe() (*NetConn, *NetConn) {
+	conn1, conn2 := net.Pipe()
+	return NewNetConn(conn1), NewNetConn(conn2)
+}
+
 // LocalAddr returns the local network address.
 func (c *NetConn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
@@ -33,3 +43,13 @@ func (c *NetConn) RemoteAddr() net.Addr {
 func (c *NetConn) UnderlyingConn() net.Conn {
 	return c.conn
 }
+
+// ConnectionState returns the state of the underlying TLS connection. False is
+// returned if the connection does not use TLS.
+func (c *NetConn) ConnectionState() (tls.ConnectionState, bool) {
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"io"
 	"testing"
 	"time"
 
@@ -25,6 +26,10 @@ func TestNetConnDecodeError(t *testing.T) {
 	abstractConnDecodeErrorTest(t, "tcp")
 }
 
+func TestNetConnKeepOpen(t *testing.T) {
+	abstractConnKeepOpenTest(t, "tcp")
+}
+
 func TestNetConnSendAfterClose(t *testing.T) {
 	abstractConnSendAfterCloseTest(t, "tcp")
 }
@@ -53,10 +58,19 @@ func TestNetConnAddr(t *testing.T) {
 	abstractConnAddrTest(t, "tcp")
 }
 
+func TestNetConnConnectionState(t *testing.T) {
+	abstractConnConnectionStateTest(t, "tcp", false)
+	abstractConnConnectionStateTest(t, "tls", true)
+}
+
 func TestNetConnAsyncSend(t *testing.T) {
 	abstractConnAsyncSendTest(t, "tcp")
 }
 
+func TestNetConnFlush(t *testing.T) {
+	abstractConnFlushTest(t, "tcp")
+}
+
 func TestNetConnSendAfterAsyncSend(t *testing.T) {
 	abstractConnSendAfterAsyncSendTest(t, "tcp")
 }
@@ -187,3 +201,36 @@ func BenchmarkNetConnAsync(b *testing.B) {
 
 	safeReceive(done)
 }
+
+func TestPipe(t *testing.T) {
+	conn1, conn2 := Pipe()
+
+	done := make(chan struct{})
+
+	go func() {
+		pkt, err := conn2.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.NewConnect(), pkt)
+
+		err = conn2.Send(packet.NewConnack(), false)
+		assert.NoError(t, err)
+
+		pkt, err = conn2.Receive()
+		assert.Nil(t, pkt)
+		assert.Equal(t, io.EOF, err)
+
+		close(done)
+	}()
+
+	err := conn1.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	pkt, err := conn1.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.NewConnack(), pkt)
+
+	err = conn1.Close()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
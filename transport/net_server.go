@@ -37,6 +37,17 @@ func CreateSecureNetServer(address string, config *tls.Config) (*NetServer, erro
 	return NewNetServer(listener), nil
 }
 
+// CreateUnixServer creates a new server that listens on the unix domain socket
+// at the provided path. The socket file is removed when the server is closed.
+func CreateUnixServer(path string) (*NetServer, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNetServer(listener), nil
+}
+
 // Accept will return the next available connection or block until a
 // connection becomes available, otherwise returns an Error.
 func (s *NetServer) Accept() (Conn, error) {
@@ -1,7 +1,14 @@
 package transport
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTCPServer(t *testing.T) {
@@ -31,3 +38,44 @@ func TestNetServerCloseAfterClose(t *testing.T) {
 func TestNetServerAddr(t *testing.T) {
 	abstractServerAddrTest(t, "tcp")
 }
+
+func TestUnixServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-transport")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mqtt.sock")
+
+	server, err := Launch("unix://" + path)
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		conn, err := server.Accept()
+		assert.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, packet.NewConnect(), pkt)
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		close(done)
+	}()
+
+	conn, err := Dial("unix://" + path)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewConnect(), false)
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -12,3 +12,20 @@ var ErrUnsupportedProtocol = errors.New("unsupported protocol")
 //
 // Note: this error is wrapped in an Error with NetworkError code.
 var ErrAcceptAfterClose = errors.New("accept after close")
+
+// A HandshakeError is returned by the Dialer if the TLS handshake with the
+// server failed. This allows callers to distinguish certificate and protocol
+// problems from plain network errors.
+type HandshakeError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *HandshakeError) Error() string {
+	return "tls handshake failed: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
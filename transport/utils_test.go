@@ -1,9 +1,11 @@
 package transport
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -127,3 +129,74 @@ func safeReceive(ch chan struct{}) {
 	case <-ch:
 	}
 }
+
+// a listener that records the data read from and written to accepted
+// connections
+type recordingListener struct {
+	net.Listener
+	conns chan *recordingConn
+}
+
+func newRecordingListener() *recordingListener {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+
+	return &recordingListener{
+		Listener: listener,
+		conns:    make(chan *recordingConn, 10),
+	}
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &recordingConn{Conn: conn}
+	l.conns <- rc
+
+	return rc, nil
+}
+
+type recordingConn struct {
+	net.Conn
+
+	read    int
+	written bytes.Buffer
+	mutex   sync.Mutex
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mutex.Lock()
+	c.read += n
+	c.mutex.Unlock()
+
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	c.written.Write(p)
+	c.mutex.Unlock()
+
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) bytesRead() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.read
+}
+
+func (c *recordingConn) bytesWritten() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]byte(nil), c.written.Bytes()...)
+}
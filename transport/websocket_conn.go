@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
@@ -124,3 +125,13 @@ func (c *WebSocketConn) RemoteAddr() net.Addr {
 func (c *WebSocketConn) UnderlyingConn() *websocket.Conn {
 	return c.conn
 }
+
+// ConnectionState returns the state of the underlying TLS connection. False is
+// returned if the connection does not use TLS.
+func (c *WebSocketConn) ConnectionState() (tls.ConnectionState, bool) {
+	if tlsConn, ok := c.conn.UnderlyingConn().(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"bytes"
 	"io"
 	"testing"
 
@@ -26,6 +27,10 @@ func TestWebSocketConnDecodeError(t *testing.T) {
 	abstractConnDecodeErrorTest(t, "ws")
 }
 
+func TestWebSocketConnKeepOpen(t *testing.T) {
+	abstractConnKeepOpenTest(t, "ws")
+}
+
 func TestWebSocketConnSendAfterClose(t *testing.T) {
 	abstractConnSendAfterCloseTest(t, "ws")
 }
@@ -54,10 +59,19 @@ func TestWebSocketConnAddr(t *testing.T) {
 	abstractConnAddrTest(t, "ws")
 }
 
+func TestWebSocketConnConnectionState(t *testing.T) {
+	abstractConnConnectionStateTest(t, "ws", false)
+	abstractConnConnectionStateTest(t, "wss", true)
+}
+
 func TestWebSocketConnAsyncSend(t *testing.T) {
 	abstractConnAsyncSendTest(t, "ws")
 }
 
+func TestWebSocketConnFlush(t *testing.T) {
+	abstractConnFlushTest(t, "ws")
+}
+
 func TestWebSocketConnSendAfterAsyncSend(t *testing.T) {
 	abstractConnSendAfterAsyncSendTest(t, "ws")
 }
@@ -220,3 +234,70 @@ func BenchmarkWebSocketConnAsync(b *testing.B) {
 
 	safeReceive(done)
 }
+
+func BenchmarkWebSocketConnPlain(b *testing.B) {
+	webSocketCompressionBenchmark(b, false)
+}
+
+func BenchmarkWebSocketConnCompressed(b *testing.B) {
+	webSocketCompressionBenchmark(b, true)
+}
+
+func webSocketCompressionBenchmark(b *testing.B, compression bool) {
+	pkt := packet.NewPublish()
+	pkt.Message.Topic = "foo/bar/baz"
+	pkt.Message.Payload = bytes.Repeat([]byte(`{"sensor":"temperature","value":21.5,"unit":"celsius"},`), 20)
+
+	listener := newRecordingListener()
+
+	server := NewWebSocketServer(listener)
+	server.SetCompression(compression)
+
+	done := make(chan struct{})
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			panic(err)
+		}
+
+		for i := 0; i < b.N; i++ {
+			_, err := conn.Receive()
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		close(done)
+	}()
+
+	dialer := NewDialer()
+	dialer.WebSocketCompression = compression
+
+	conn, err := dialer.Dial(getURL(server, "ws"))
+	if err != nil {
+		panic(err)
+	}
+
+	rc := <-listener.conns
+	handshake := rc.bytesRead()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := conn.Send(pkt, false)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	safeReceive(done)
+
+	b.StopTimer()
+
+	b.SetBytes(int64(pkt.Len()))
+	b.ReportMetric(float64(rc.bytesRead()-handshake)/float64(b.N), "wire-B/op")
+
+	_ = conn.Close()
+	_ = server.Close()
+}
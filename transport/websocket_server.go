@@ -86,6 +86,13 @@ func (s *WebSocketServer) SetFallback(handler http.Handler) {
 	s.fallback = handler
 }
 
+// SetCompression enables the negotiation of the permessage-deflate extension
+// if requested by the client. It is disabled by default as compression trades
+// CPU for bandwidth on compressible payloads.
+func (s *WebSocketServer) SetCompression(enabled bool) {
+	s.upgrader.EnableCompression = enabled
+}
+
 // SetOriginChecker sets an optional function that allows check the request origin
 // before accepting the connection.
 func (s *WebSocketServer) SetOriginChecker(fn func(r *http.Request) bool) {
@@ -1,10 +1,14 @@
 package transport
 
 import (
+	"bufio"
+	"bytes"
 	"io/ioutil"
 	"net/http"
 	"testing"
 
+	"github.com/256dpi/gomqtt/packet"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -115,3 +119,81 @@ func TestWebSocketOriginChecker(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, conn)
 }
+
+func TestWebSocketCompression(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		listener := newRecordingListener()
+
+		server := NewWebSocketServer(listener)
+		server.SetCompression(enabled)
+
+		var offered string
+		server.SetOriginChecker(func(r *http.Request) bool {
+			offered = r.Header.Get("Sec-WebSocket-Extensions")
+			return true
+		})
+
+		publish := packet.NewPublish()
+		publish.Message.Topic = "test"
+		publish.Message.Payload = bytes.Repeat([]byte("test"), 1000)
+
+		done := make(chan struct{})
+
+		go func() {
+			conn, err := server.Accept()
+			require.NoError(t, err)
+
+			pkt, err := conn.Receive()
+			assert.NoError(t, err)
+			assert.Equal(t, publish, pkt)
+
+			err = conn.Send(publish, false)
+			assert.NoError(t, err)
+
+			close(done)
+		}()
+
+		dialer := NewDialer()
+		dialer.WebSocketCompression = true
+
+		conn, err := dialer.Dial(getURL(server, "ws"))
+		require.NoError(t, err)
+
+		err = conn.Send(publish, false)
+		assert.NoError(t, err)
+
+		pkt, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, publish, pkt)
+
+		safeReceive(done)
+
+		// check offered extension
+		assert.Contains(t, offered, "permessage-deflate")
+
+		// check negotiated extension
+		rc := <-listener.conns
+		reader := bufio.NewReader(bytes.NewReader(rc.bytesWritten()))
+		res, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+
+		// check the rsv1 bit of the first frame that marks compressed messages
+		header, err := reader.ReadByte()
+		require.NoError(t, err)
+
+		if enabled {
+			assert.Contains(t, res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+			assert.NotZero(t, header&0x40)
+		} else {
+			assert.Empty(t, res.Header.Get("Sec-WebSocket-Extensions"))
+			assert.Zero(t, header&0x40)
+		}
+
+		err = conn.Close()
+		assert.NoError(t, err)
+
+		err = server.Close()
+		assert.NoError(t, err)
+	}
+}